@@ -0,0 +1,393 @@
+// Admin-only endpoints, disabled unless explicitly enabled and protected by admin tokens
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	defaultAdminQueryTimeout = 5 * time.Second
+	defaultAdminQueryMaxRows = 100
+	maxAdminQueryBodyBytes   = 64 << 10
+)
+
+var adminCfg adminConfig
+
+type adminConfig struct {
+	// Admin token -> admin name, used to identify who ran what
+	Tokens  map[string]string
+	QueryOn bool
+	// Serve the resolved configuration at GET /config
+	ConfigOn bool
+	// Accept inserts at POST /coffee
+	CoffeeOn bool
+	Timeout  time.Duration
+	MaxRows  int
+}
+
+type adminQueryRequest struct {
+	Query string `json:"query"`
+}
+
+type adminQueryResponse struct {
+	Columns   []string        `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	Truncated bool            `json:"truncated"`
+}
+
+type adminIdentityKey struct{}
+
+// Reads the admin configuration. ADMIN_TOKENS is a comma separated list of name:token pairs,
+// ENABLE_ADMIN_QUERY=true turns on the query console, ENABLE_CONFIG_ENDPOINT=true GET /config
+// and ENABLE_COFFEE_WRITES=true POST /coffee. None starts without tokens.
+func initAdmin() {
+	tokens := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("ADMIN_TOKENS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, token, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || name == "" || token == "" {
+			// Don't echo the entry, it may be a bare token
+			log.Fatalln("Invalid ADMIN_TOKENS entry (expecting name:token)")
+		}
+		tokens[token] = name
+	}
+
+	queryOn := os.Getenv("ENABLE_ADMIN_QUERY") == "true"
+	if queryOn && len(tokens) == 0 {
+		log.Fatalln("ENABLE_ADMIN_QUERY is set but no ADMIN_TOKENS are configured")
+	}
+	configOn := os.Getenv("ENABLE_CONFIG_ENDPOINT") == "true"
+	if configOn && len(tokens) == 0 {
+		log.Fatalln("ENABLE_CONFIG_ENDPOINT is set but no ADMIN_TOKENS are configured")
+	}
+	coffeeOn := os.Getenv("ENABLE_COFFEE_WRITES") == "true"
+	if coffeeOn && len(tokens) == 0 {
+		log.Fatalln("ENABLE_COFFEE_WRITES is set but no ADMIN_TOKENS are configured")
+	}
+
+	timeout, err := envSeconds("ADMIN_QUERY_TIMEOUT_S", defaultAdminQueryTimeout)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	maxRows := defaultAdminQueryMaxRows
+	if v := os.Getenv("ADMIN_QUERY_MAX_ROWS"); v != "" {
+		maxRows, err = strconv.Atoi(v)
+		if err != nil || maxRows <= 0 {
+			log.Fatalf("Invalid ADMIN_QUERY_MAX_ROWS %v\n", v)
+		}
+	}
+	if queryOn {
+		slog.Info("Admin query console enabled", "admins", len(tokens))
+	}
+
+	adminCfg = adminConfig{
+		Tokens:   tokens,
+		QueryOn:  queryOn,
+		ConfigOn: configOn,
+		CoffeeOn: coffeeOn,
+		Timeout:  timeout,
+		MaxRows:  maxRows,
+	}
+}
+
+// Rejects requests without a valid admin bearer token and records the admin's name in the context
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A token sent bare, without the Bearer scheme, isn't accepted
+		auth := r.Header.Get("Authorization")
+		bearer := strings.HasPrefix(auth, "Bearer ")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		for token, name := range adminCfg.Tokens {
+			if bearer && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, name)))
+				return
+			}
+		}
+		loggerFrom(r.Context()).Warn("Admin: Rejected unauthenticated request", "remote_addr", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// Statements, clauses and functions that can write, lock, affect other sessions or hide part of the
+// query. This is a first line of defence: queries also run in a read-only transaction.
+var adminQueryDenied = regexp.MustCompile(`(?i)\b(insert|update|delete|merge|replace|drop|create|alter|truncate|rename|grant|revoke|call|exec|execute|do|copy|into|lock|set|load|handler|outfile|dumpfile|set_config|pg_terminate_backend|pg_cancel_backend|pg_reload_conf|dblink\w*)\b|--|/\*|#`)
+
+// Checks a query is a single read-only SELECT
+func validateReadOnlyQuery(q string) error {
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return fmt.Errorf("query is empty")
+	}
+	if strings.Contains(q, ";") {
+		return fmt.Errorf("query must be a single statement without semicolons")
+	}
+	if first := strings.Fields(q)[0]; !strings.EqualFold(first, "select") {
+		return fmt.Errorf("only SELECT queries are allowed")
+	}
+	if m := adminQueryDenied.FindString(q); m != "" {
+		return fmt.Errorf("query contains %q, which is not allowed", m)
+	}
+	return nil
+}
+
+// Runs a read-only SELECT against the configured database for diagnostics
+func adminQueryHandler(w http.ResponseWriter, r *http.Request) {
+	admin := r.Context().Value(adminIdentityKey{}).(string)
+	l := loggerFrom(r.Context()).With("admin", admin)
+
+	var req adminQueryRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminQueryBodyBytes)).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	l.Info("Admin Query: Running query", "query", req.Query)
+	if err := validateReadOnlyQuery(req.Query); err != nil {
+		l.Warn("Admin Query: Rejected query", "error", err)
+		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), adminCfg.Timeout)
+	defer cancel()
+	res, err := adminQuery(ctx, selectedDBType, req.Query)
+	if err != nil {
+		l.Error("Admin Query: Query failed", "error", err)
+		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	l.Info("Admin Query: Returned rows", "rows", len(res.Rows), "truncated", res.Truncated)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Runs the query in a read-only transaction through engine's shared pool
+func adminQuery(ctx context.Context, engine string, query string) (adminQueryResponse, error) {
+	backend, err := backendFor(engine)
+	if err != nil {
+		return adminQueryResponse{}, err
+	}
+	switch b := backend.(type) {
+	case postgresBackend:
+		pool, err := sharedPostgresPool(ctx, b.Engine)
+		if err != nil {
+			return adminQueryResponse{}, err
+		}
+		return adminQueryPostgres(ctx, pool, query)
+	case sqlBackend:
+		db, err := sharedSQLDB(ctx, b.Engine)
+		if err != nil {
+			return adminQueryResponse{}, err
+		}
+		return adminQuerySQL(ctx, db, b.Dialect, query)
+	default:
+		return adminQueryResponse{}, fmt.Errorf("%w: the admin query console needs a database, not %v", ErrUnknownDBType, engine)
+	}
+}
+
+// Refuses ENABLE_ADMIN_QUERY on a DB type without a database to query, such as FAKE
+func checkAdminQuery(dbType string) error {
+	if !adminCfg.QueryOn {
+		return nil
+	}
+	backend, err := backendFor(dbType)
+	if err != nil {
+		return err
+	}
+	switch backend.(type) {
+	case postgresBackend, sqlBackend:
+		return nil
+	}
+	return fmt.Errorf("ENABLE_ADMIN_QUERY is set but DB_TYPE %v has no database to query", dbType)
+}
+
+func adminQueryPostgres(ctx context.Context, pool *pgxpool.Pool, query string) (res adminQueryResponse, err error) {
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for _, f := range rows.FieldDescriptions() {
+		res.Columns = append(res.Columns, string(f.Name))
+	}
+	res.Rows = [][]interface{}{}
+	for rows.Next() {
+		if len(res.Rows) == adminCfg.MaxRows {
+			res.Truncated = true
+			break
+		}
+		values, err := rows.Values()
+		if err != nil {
+			return res, err
+		}
+		res.Rows = append(res.Rows, values)
+	}
+	return res, rows.Err()
+}
+
+// SQL Server's driver has no read-only transactions, so there the query relies on
+// validateReadOnlyQuery and on the transaction always being rolled back.
+func adminQuerySQL(ctx context.Context, db *sql.DB, dialect sqlDialect, query string) (res adminQueryResponse, err error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: dialect != dialectSQLServer})
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	res.Columns, err = rows.Columns()
+	if err != nil {
+		return res, err
+	}
+	res.Rows = [][]interface{}{}
+	for rows.Next() {
+		if len(res.Rows) == adminCfg.MaxRows {
+			res.Truncated = true
+			break
+		}
+		values := make([]interface{}, len(res.Columns))
+		ptrs := make([]interface{}, len(values))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return res, err
+		}
+		// The drivers return some values (most on MySQL) as bytes, which would otherwise encode as base64
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		res.Rows = append(res.Rows, values)
+	}
+	return res, rows.Err()
+}
+
+// Stands in for secrets in GET /config
+const maskedSecret = "****"
+
+// What GET /config shows of the configuration the instance resolved, with secrets masked
+type configResponse struct {
+	DBType string `json:"db_type"`
+	// The primary's connection settings, unless they couldn't be loaded (e.g. on SQLite)
+	DB      *DBConnectionInfo `json:"db,omitempty"`
+	DBError string            `json:"db_error,omitempty"`
+	// DB_PATH, for SQLite
+	DBPath       string `json:"db_path,omitempty"`
+	ReadInstance string `json:"read_instance,omitempty"`
+	IPType       string `json:"ip_type,omitempty"`
+	Pool         struct {
+		MaxConns        int    `json:"max_conns"`
+		MinConns        int    `json:"min_conns"`
+		MaxConnLifetime string `json:"max_conn_lifetime"`
+	} `json:"pool"`
+	Bond struct {
+		URL              string   `json:"url"`
+		VerifyPath       string   `json:"verify_path"`
+		VerifyBatchPath  string   `json:"verify_batch_path"`
+		VerifyMethod     string   `json:"verify_method"`
+		ForwardParams    []string `json:"forward_params,omitempty"`
+		ValidateResponse bool     `json:"validate_response"`
+		Timeout          string   `json:"timeout"`
+		MaxRetries       int      `json:"max_retries"`
+		RetryBaseDelay   string   `json:"retry_base_delay"`
+		Auth             bool     `json:"auth"`
+		Skip             bool     `json:"skip"`
+	} `json:"bond"`
+	Query struct {
+		CustomQuery      bool   `json:"custom_query"`
+		MagicIndex       int    `json:"magic_index"`
+		MaxLimit         int    `json:"max_limit"`
+		SQLAggregate     bool   `json:"sql_aggregate"`
+		PriceParseMode   string `json:"price_parse_mode"`
+		EmptyResultMode  string `json:"empty_result_mode,omitempty"`
+		ResponseEnvelope bool   `json:"response_envelope"`
+	} `json:"query"`
+}
+
+// The settings the instance is running with, for debugging deployments. The database password
+// is masked, as is any password in Bond's URL. DB_DSN_TEMPLATE is shown as configured, which has
+// {pass} where the password goes.
+// Settings are validated at startup, so they are read here without checking them again.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	res := configResponse{
+		DBType:       os.Getenv("DB_TYPE"),
+		DBPath:       os.Getenv("DB_PATH"),
+		ReadInstance: os.Getenv("DB_READ_INSTANCE"),
+		IPType:       os.Getenv("DB_IP_TYPE"),
+	}
+	if info, err := dbConnectionInfo(); err != nil {
+		res.DBError = err.Error()
+	} else {
+		if info.Pass != "" {
+			info.Pass = maskedSecret
+		}
+		res.DB = &info
+	}
+
+	res.Pool.MaxConns = dbPool.MaxConns
+	res.Pool.MinConns = dbPool.MinConns
+	res.Pool.MaxConnLifetime = dbPool.MaxConnLifetime.String()
+
+	res.Bond.URL = bondCfg.BondURL
+	if u, err := url.Parse(bondCfg.BondURL); err == nil {
+		res.Bond.URL = u.Redacted()
+	}
+	res.Bond.VerifyPath = bondCfg.VerifyPath
+	res.Bond.VerifyBatchPath = bondCfg.VerifyBatchPath
+	res.Bond.VerifyMethod = bondCfg.VerifyMethod
+	res.Bond.ForwardParams = bondCfg.ForwardParams
+	res.Bond.ValidateResponse = bondCfg.ValidateResponse
+	res.Bond.Timeout = bondCfg.Timeout.String()
+	res.Bond.MaxRetries = bondCfg.MaxRetries
+	res.Bond.RetryBaseDelay = bondCfg.RetryBaseDelay.String()
+	res.Bond.Auth = bondCfg.TokenSource != nil
+	res.Bond.Skip = skipBond()
+
+	res.Query.CustomQuery = os.Getenv("QUERY") != ""
+	res.Query.MagicIndex, _ = magicIndex()
+	res.Query.MaxLimit, _ = queryMaxLimit()
+	res.Query.SQLAggregate = sqlAggregate()
+	res.Query.PriceParseMode, _ = priceParseMode()
+	res.Query.EmptyResultMode = os.Getenv("EMPTY_RESULT_MODE")
+	res.Query.ResponseEnvelope = responseEnvelope()
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Chi router for the admin endpoints, all of which require an admin token
+func adminRouter(r chi.Router) {
+	r.Use(adminAuth)
+	if adminCfg.QueryOn {
+		r.Post("/query", adminQueryHandler)
+	}
+}
@@ -0,0 +1,117 @@
+// Totals the coffee table in the database rather than reading every row, see SQL_AGGREGATE
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v4"
+	"modernc.org/sqlite"
+)
+
+// Count and total in cents of the coffee table, given the quoted price column and table, or the
+// union of DB_TABLES. Prices are rounded to the cent before summing, as parsePriceCents does.
+// SQLite only makes integers with "as integer", which MySQL rejects.
+const (
+	postgresAggregateQuery = "select count(*), coalesce(sum(round(cast(%v as numeric) * 100)), 0)::bigint from %v"
+	mySQLAggregateQuery    = "select count(*), coalesce(sum(cast(round(cast(%v as decimal(20,3)) * 100) as signed)), 0) from %v"
+	sqliteAggregateQuery   = "select count(*), coalesce(sum(cast(round(cast(%v as real) * 100) as integer)), 0) from %v"
+)
+
+// The bean of the magic coffee row, given the quoted bean column, the table and the ORDER BY of
+// the row scan. A single table has no ORDER BY, as the row scan reads it in its natural order, but
+// the database can still stop at the magic row instead of reading the whole table.
+const (
+	postgresMagicQuery = "select coalesce(%v, '') from %v%v limit 1 offset $1"
+	sqlMagicQuery      = "select %v from %v%v limit 1 offset ?"
+)
+
+// Whether SQL_AGGREGATE asks for the total to be computed by the database
+func sqlAggregate() bool {
+	return os.Getenv("SQL_AGGREGATE") == "true"
+}
+
+// Checks SQL_AGGREGATE can be used with engine. The aggregate queries read the coffee table
+// directly (see coffeeSchema), so they can't honour a custom QUERY, and there are none for SQL
+// Server.
+func checkSQLAggregate(engine string) error {
+	if !sqlAggregate() {
+		return nil
+	}
+	if os.Getenv("QUERY") != "" {
+		return fmt.Errorf("SQL_AGGREGATE can't be used with QUERY")
+	}
+	if engine == "CLOUD_SQL_SQLSERVER" {
+		return fmt.Errorf("SQL_AGGREGATE isn't supported on %v", engine)
+	}
+	return nil
+}
+
+// Whether this request can be answered by the aggregate queries. Detail and paged requests need
+// the rows themselves, so they always scan.
+func useSQLAggregate(ctx context.Context) bool {
+	if !sqlAggregate() || wantCoffeeDetail(ctx) {
+		return false
+	}
+	_, paged := coffeePageFrom(ctx)
+	return !paged
+}
+
+// Totals the coffee table on Postgres. A price that isn't a number fails the query, whatever
+// PRICE_PARSE_MODE says.
+func DDDPostgresAggregate(ctx context.Context, pool pgxRowQuerier) (result DDDBondPayload, err error) {
+	magic, err := magicIndex()
+	if err != nil {
+		return result, err
+	}
+	s, err := quotedCoffeeSchema(dialectPostgres)
+	if err != nil {
+		return result, err
+	}
+	if err := pool.QueryRow(ctx, fmt.Sprintf(postgresAggregateQuery, s.Price, s.source())).Scan(&result.RowCount, &result.TotalCents); err != nil {
+		loggerFrom(ctx).Error("query failed", "error", err)
+		return result, err
+	}
+	result.Total = int(result.TotalCents / 100)
+	err = pool.QueryRow(ctx, fmt.Sprintf(postgresMagicQuery, s.Bean, s.source(), s.order()), magic).Scan(&result.MagicCoffee)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		loggerFrom(ctx).Error("query failed", "error", err)
+		return result, err
+	}
+	logMagicOutOfRange(ctx, magic, result.RowCount)
+	return result, nil
+}
+
+// Totals the coffee table on MySQL or SQLite. These cast a price that isn't a number to 0, so it
+// adds nothing to the total, whatever PRICE_PARSE_MODE says.
+func DDDMySQLAggregate(ctx context.Context, db *sql.DB) (result DDDBondPayload, err error) {
+	magic, err := magicIndex()
+	if err != nil {
+		return result, err
+	}
+	s, err := quotedCoffeeSchema(dialectMySQL)
+	if err != nil {
+		return result, err
+	}
+	query := mySQLAggregateQuery
+	if _, ok := db.Driver().(*sqlite.Driver); ok {
+		query = sqliteAggregateQuery
+	}
+	if err := db.QueryRowContext(ctx, fmt.Sprintf(query, s.Price, s.source())).Scan(&result.RowCount, &result.TotalCents); err != nil {
+		loggerFrom(ctx).Error("query failed", "error", err)
+		return result, err
+	}
+	result.Total = int(result.TotalCents / 100)
+	var bean sql.NullString
+	err = db.QueryRowContext(ctx, fmt.Sprintf(sqlMagicQuery, s.Bean, s.source(), s.order()), magic).Scan(&bean)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		loggerFrom(ctx).Error("query failed", "error", err)
+		return result, err
+	}
+	result.MagicCoffee = bean.String
+	logMagicOutOfRange(ctx, magic, result.RowCount)
+	return result, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/pashagolub/pgxmock"
+)
+
+// Creates a SQLite coffee table with n rows priced 2.50, 2.51, ... 2.99, 2.50, ...
+func sqliteCoffee(tb testing.TB, n int) *sql.DB {
+	tb.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(tb.TempDir(), "coffee.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("create table coffee (id integer primary key, bean text, price text)"); err != nil {
+		tb.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := tx.Exec("insert into coffee values (?, ?, ?)", i+1, fmt.Sprintf("Bean-%d", i), fmt.Sprintf("2.%02d", 50+i%50)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+func Test_DDDMySQLAggregate(t *testing.T) {
+	for _, n := range []int{0, 10, 1000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			db := sqliteCoffee(t, n)
+			scanned, err := DDDMySQLRows(context.Background(), db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("SQL_AGGREGATE", "true")
+			got, err := DDDMySQLRows(context.Background(), db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got.QueryDurationMs, scanned.QueryDurationMs = 0, 0
+			if !reflect.DeepEqual(got, scanned) {
+				t.Errorf("aggregate = %+v, expected %+v as from the row scan", got, scanned)
+			}
+		})
+	}
+}
+
+func Test_DDDPostgresAggregate(t *testing.T) {
+	t.Setenv("SQL_AGGREGATE", "true")
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`select count(*), coalesce(sum(round(cast("price" as numeric) * 100)), 0)::bigint from "coffee"`)).
+		WillReturnRows(pgxmock.NewRows([]string{"count", "sum"}).AddRow(60, int64(15025)))
+	mock.ExpectQuery(regexp.QuoteMeta(`select coalesce("bean", '') from "coffee" limit 1 offset $1`)).WithArgs(defaultMagicIndex).
+		WillReturnRows(pgxmock.NewRows([]string{"bean"}).AddRow("Bean-50"))
+
+	got, err := DDDPostgresRows(context.Background(), mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DDDBondPayload{MagicCoffee: "Bean-50", Total: 150, TotalCents: 15025, RowCount: 60}
+	got.QueryDurationMs = 0
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DDDPostgresRows = %+v, expected %+v", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_UseSQLAggregate(t *testing.T) {
+	t.Setenv("SQL_AGGREGATE", "true")
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want bool
+	}{
+		{name: "totals", ctx: context.Background(), want: true},
+		{name: "detail", ctx: withCoffeeDetail(context.Background())},
+		{name: "page", ctx: withCoffeePage(context.Background(), coffeePage{Limit: 10})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := useSQLAggregate(tt.ctx); got != tt.want {
+				t.Errorf("useSQLAggregate = %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_CheckSQLAggregate(t *testing.T) {
+	tests := []struct {
+		name      string
+		engine    string
+		aggregate string
+		query     string
+		wantErr   bool
+	}{
+		{name: "postgres", engine: "CLOUD_SQL_POSTGRES", aggregate: "true"},
+		{name: "mysql", engine: "CLOUD_SQL_MYSQL", aggregate: "true"},
+		{name: "with QUERY", engine: "CLOUD_SQL_MYSQL", aggregate: "true", query: "select id, name, cost from beans", wantErr: true},
+		{name: "sql server", engine: "CLOUD_SQL_SQLSERVER", aggregate: "true", wantErr: true},
+		{name: "sql server without SQL_AGGREGATE", engine: "CLOUD_SQL_SQLSERVER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SQL_AGGREGATE", tt.aggregate)
+			t.Setenv("QUERY", tt.query)
+			if err := checkSQLAggregate(tt.engine); (err != nil) != tt.wantErr {
+				t.Errorf("checkSQLAggregate(%v) error = %v, wantErr %v", tt.engine, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Row scan against SQL aggregate on a local SQLite file (go test -bench DDDMySQL -run ^$):
+//
+//	BenchmarkDDDMySQLRows/rows=1000         	     900	   1557001 ns/op
+//	BenchmarkDDDMySQLRows/rows=100000       	       8	 154950044 ns/op
+//	BenchmarkDDDMySQLAggregate/rows=1000    	    6271	    197629 ns/op
+//	BenchmarkDDDMySQLAggregate/rows=100000  	      70	  17439074 ns/op
+//
+// The gap is wider against Cloud SQL, where the row scan also sends every row over the network.
+func BenchmarkDDDMySQLRows(b *testing.B) {
+	benchmarkDDD(b, "false")
+}
+
+func BenchmarkDDDMySQLAggregate(b *testing.B) {
+	benchmarkDDD(b, "true")
+}
+
+func benchmarkDDD(b *testing.B, aggregate string) {
+	b.Setenv("SQL_AGGREGATE", aggregate)
+	for _, n := range []int{1000, 100000} {
+		db := sqliteCoffee(b, n)
+		b.Run(fmt.Sprintf("rows=%v", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := DDDMySQLRows(context.Background(), db); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
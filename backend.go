@@ -0,0 +1,115 @@
+// The data stores the coffee rows can be read from
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reads the coffee rows and aggregates them into the payload sent to Bond. Request options such
+// as ?detail=true and pages come through the context.
+type CoffeeBackend interface {
+	Fetch(ctx context.Context) (DDDBondPayload, error)
+}
+
+// The backend for each database. DB_TYPE is checked against it at startup, and the engine of
+// POST /v2/verify per request. FAKE isn't one of them: it is only served when it is DB_TYPE (see
+// selectBackend), so a real deployment can't be asked to verify made-up rows.
+var coffeeBackends = map[string]CoffeeBackend{
+	"ALLOY_DB":            postgresBackend{Engine: "ALLOY_DB"},
+	"CLOUD_SQL_POSTGRES":  postgresBackend{Engine: "CLOUD_SQL_POSTGRES"},
+	"CLOUD_SQL_MYSQL":     sqlBackend{Engine: "CLOUD_SQL_MYSQL", ReadReplica: true},
+	"CLOUD_SQL_SQLSERVER": sqlBackend{Engine: "CLOUD_SQL_SQLSERVER", Dialect: dialectSQLServer, ReadReplica: true},
+	"SQLITE":              sqlBackend{Engine: "SQLITE"},
+}
+
+// The DB type the app serves and its backend, chosen once at startup by selectBackend
+var (
+	selectedDBType  string
+	selectedBackend CoffeeBackend
+)
+
+// Checks dbType and makes its backend the one GET /data_driven_decaf/ and the verification job
+// read from. FAKE is only available this way.
+func selectBackend(dbType string) error {
+	if err := validateDBType(dbType); err != nil {
+		return err
+	}
+	selectedDBType, selectedBackend = dbType, coffeeBackends[dbType]
+	if dbType == "FAKE" {
+		selectedBackend = fakeBackend{Coffees: fakeCoffees}
+	}
+	return nil
+}
+
+// The backend for engine: the selected one, or another of coffeeBackends
+func backendFor(engine string) (CoffeeBackend, error) {
+	if engine == selectedDBType && selectedBackend != nil {
+		return selectedBackend, nil
+	}
+	if b, ok := coffeeBackends[engine]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("%w %v", ErrUnknownDBType, engine)
+}
+
+// The engines of coffeeBackends in order, and FAKE if fake is set, for error messages
+func backendEngines(fake bool) string {
+	engines := make([]string, 0, len(coffeeBackends)+1)
+	for engine := range coffeeBackends {
+		engines = append(engines, engine)
+	}
+	if fake {
+		engines = append(engines, "FAKE")
+	}
+	sort.Strings(engines)
+	return strings.Join(engines, ", ")
+}
+
+// AlloyDB or Cloud SQL Postgres, read through the engine's shared pool, on the read replica if
+// DB_READ_INSTANCE is set
+type postgresBackend struct {
+	Engine string
+}
+
+func (b postgresBackend) Fetch(ctx context.Context) (result DDDBondPayload, err error) {
+	pool, err := sharedPostgresPool(withReadReplica(ctx), b.Engine)
+	if err != nil {
+		return result, err
+	}
+	ctx, span := startQuerySpan(ctx, b.Engine)
+	start := time.Now()
+	result, err = DDDPostgresRows(ctx, pool)
+	observeQuery(b.Engine, start, err)
+	endSpan(span, err)
+	return result, err
+}
+
+// Cloud SQL MySQL, Cloud SQL SQL Server or SQLite, whose rows are processed the same way, read
+// through the engine's shared database/sql handle
+type sqlBackend struct {
+	Engine string
+	// How the coffee query is written. The zero value, MySQL's, also suits SQLite.
+	Dialect sqlDialect
+	// Read from the read replica if DB_READ_INSTANCE is set
+	ReadReplica bool
+}
+
+func (b sqlBackend) Fetch(ctx context.Context) (result DDDBondPayload, err error) {
+	if b.ReadReplica {
+		ctx = withReadReplica(ctx)
+	}
+	db, err := sharedSQLDB(ctx, b.Engine)
+	if err != nil {
+		return result, err
+	}
+	ctx, span := startQuerySpan(ctx, b.Engine)
+	start := time.Now()
+	result, err = sqlRows(ctx, db, b.Dialect)
+	observeQuery(b.Engine, start, err)
+	endSpan(span, err)
+	return result, err
+}
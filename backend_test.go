@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Starts the app on dbType for the duration of a test, as main does with selectBackend. A DB type
+// selectBackend rejects is still set, so the handlers can be tested with it.
+func useDBType(t *testing.T, dbType string) {
+	t.Setenv("DB_TYPE", dbType)
+	origType, origBackend := selectedDBType, selectedBackend
+	t.Cleanup(func() { selectedDBType, selectedBackend = origType, origBackend })
+	if err := selectBackend(dbType); err != nil {
+		selectedDBType, selectedBackend = dbType, nil
+	}
+}
+
+func Test_CoffeeBackends(t *testing.T) {
+	tests := []struct {
+		dbType string
+		want   CoffeeBackend
+	}{
+		{dbType: "ALLOY_DB", want: postgresBackend{Engine: "ALLOY_DB"}},
+		{dbType: "CLOUD_SQL_POSTGRES", want: postgresBackend{Engine: "CLOUD_SQL_POSTGRES"}},
+		{dbType: "CLOUD_SQL_MYSQL", want: sqlBackend{Engine: "CLOUD_SQL_MYSQL", ReadReplica: true}},
+		{dbType: "CLOUD_SQL_SQLSERVER", want: sqlBackend{Engine: "CLOUD_SQL_SQLSERVER", Dialect: dialectSQLServer, ReadReplica: true}},
+		{dbType: "SQLITE", want: sqlBackend{Engine: "SQLITE"}},
+	}
+	for _, tt := range tests {
+		if got := coffeeBackends[tt.dbType]; got != tt.want {
+			t.Errorf("coffeeBackends[%v] = %#v, expected %#v", tt.dbType, got, tt.want)
+		}
+		if err := validateDBType(tt.dbType); err != nil {
+			t.Errorf("validateDBType(%v) error = %v", tt.dbType, err)
+		}
+	}
+
+	// FAKE is only served when the app was started with it
+	useDBType(t, "CLOUD_SQL_POSTGRES")
+	if b, err := backendFor("FAKE"); !errors.Is(err, ErrUnknownDBType) {
+		t.Errorf("backendFor(FAKE) with DB_TYPE=CLOUD_SQL_POSTGRES = %#v, %v, expected %v", b, err, ErrUnknownDBType)
+	}
+	useDBType(t, "FAKE")
+	if b, err := backendFor("FAKE"); err != nil {
+		t.Errorf("backendFor(FAKE) with DB_TYPE=FAKE error = %v", err)
+	} else if _, ok := b.(fakeBackend); !ok {
+		t.Errorf("backendFor(FAKE) = %#v, expected the fake backend", b)
+	}
+
+	// Pools are looked up by the backend's own engine, so a missing SQLite path fails as SQLite
+	t.Setenv("DB_PATH", "")
+	t.Cleanup(closePools)
+	if _, err := coffeeBackends["SQLITE"].Fetch(context.Background()); !errors.Is(err, ErrMissingDBConfig) {
+		t.Errorf("SQLITE Fetch error = %v, expected %v", err, ErrMissingDBConfig)
+	}
+}
+
+func Test_DDDHandlerErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		dbType string
+		target string
+		// Replaces the DB_TYPE's backend when set
+		connectErr error
+		bondStatus int
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "invalid page", dbType: "FAKE", target: "?limit=-1", wantStatus: http.StatusBadRequest, wantBody: `Error: invalid page: limit "-1"`},
+		{name: "invalid response", dbType: "FAKE", target: "?response=bond", wantStatus: http.StatusBadRequest, wantBody: `Error: invalid parameter: response "bond"`},
+		{name: "unknown DB type", dbType: "ORACLE", wantStatus: http.StatusInternalServerError, wantBody: "Error: unknown DB type ORACLE"},
+		{name: "database unreachable", dbType: "FAKE", connectErr: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, wantStatus: http.StatusServiceUnavailable},
+		{name: "database too slow", dbType: "FAKE", connectErr: context.DeadlineExceeded, wantStatus: http.StatusGatewayTimeout},
+		{name: "bond fails", dbType: "FAKE", bondStatus: http.StatusBadRequest, wantStatus: http.StatusBadGateway, wantBody: "Data-Driven Decaf Error: expected 200 response, got 400"},
+		{name: "ok", dbType: "FAKE", bondStatus: http.StatusOK, wantStatus: http.StatusOK, wantBody: `"magic_coffee":"Fake-50"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useDBType(t, tt.dbType)
+			if tt.connectErr != nil {
+				stubDDDConnect(t, func(ctx context.Context, dbType string) (DDDBondPayload, error) {
+					return DDDBondPayload{}, tt.connectErr
+				})
+			}
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(tt.bondStatus) })
+			rec := httptest.NewRecorder()
+			dddHandler(rec, httptest.NewRequest(http.MethodGet, "/data_driven_decaf/"+tt.target, nil))
+			if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("response = %v %q, expected %v containing %q", rec.Code, rec.Body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_ErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "invalid page", err: fmt.Errorf("%w: limit", ErrInvalidPage), want: http.StatusBadRequest},
+		{name: "invalid parameter", err: fmt.Errorf("%w: response", ErrInvalidParam), want: http.StatusBadRequest},
+		{name: "unknown DB type", err: fmt.Errorf("%w ORACLE", ErrUnknownDBType), want: http.StatusInternalServerError},
+		{name: "missing configuration", err: fmt.Errorf("%w: DB_USER", ErrMissingDBConfig), want: http.StatusInternalServerError},
+		{name: "database unreachable", err: fmt.Errorf("connect: %w", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), want: http.StatusServiceUnavailable},
+		{name: "deadline exceeded", err: fmt.Errorf("query: %w", context.DeadlineExceeded), want: http.StatusGatewayTimeout},
+		{name: "bond finds it invalid", err: fmt.Errorf("%w: total is off", ErrBondRejected), want: http.StatusUnprocessableEntity},
+		{name: "bond rejects", err: &BondError{StatusCode: http.StatusBadRequest}, want: http.StatusBadGateway},
+		{name: "bond unreachable", err: &bondRequestError{Attempts: 4, Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, want: http.StatusBadGateway},
+		{name: "bond times out", err: &bondRequestError{Attempts: 4, Err: &url.Error{Op: "Post", Err: context.DeadlineExceeded}}, want: http.StatusGatewayTimeout},
+		{name: "other", err: errors.New("boom"), want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := errorStatus(tt.err); got != tt.want {
+			t.Errorf("%v: errorStatus(%v) = %v, expected %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -4,59 +4,555 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
 )
 
-// TODO: STORE IN SECRETS MANAGER
+// Override with BOND_SERVICE_URL, which may be a Secret Manager reference
 const defaultBondURL = "https://bond-service-l5xebjflvq-ew.a.run.app"
 
 var bondCfg bondConfig
 
 type bondConfig struct {
 	BondURL string
+	// Paths of the endpoints that verify Data-Driven Decaf results, one or a batch at a time
+	VerifyPath      string
+	VerifyBatchPath string
+	// Method of the verify endpoint, from BOND_VERIFY_METHOD. Batches are always POSTed.
+	VerifyMethod string
+	// Query parameters of GET /data_driven_decaf/ passed on to Bond, from BOND_FORWARD_PARAMS
+	ForwardParams []string
+	// Whether Bond's replies to verify requests are checked to be a BondVerifyResponse, from
+	// BOND_VALIDATE_RESPONSE (see checkVerifyReply)
+	ValidateResponse bool
+	// Shared by every request to Bond so connections are kept alive and reused
+	Client *http.Client
+	// Deadline for each attempt, including reading the response, from BOND_TIMEOUT_S or
+	// BOND_HTTP_TIMEOUT_S, 0 for none. Client has no timeout of its own.
+	Timeout time.Duration
+	// Retries after a failed request, and the delay before the first one (doubled for each retry)
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	// Google-signed ID tokens for Bond's URL, nil unless BOND_AUTH is set
+	TokenSource oauth2.TokenSource
+}
+
+// Bond's URL from BOND_SERVICE_URL. Without it the production Bond service is called, with a
+// warning, unless BOND_REQUIRE_EXPLICIT=true makes that an error, so a misconfigured dev instance
+// can't call production Bond by accident.
+func bondServiceURL() (string, error) {
+	if url := os.Getenv("BOND_SERVICE_URL"); url != "" {
+		return url, nil
+	}
+	if os.Getenv("BOND_REQUIRE_EXPLICIT") == "true" {
+		return "", errors.New("BOND_SERVICE_URL not set (required with BOND_REQUIRE_EXPLICIT=true)")
+	}
+	slog.Warn("BOND_SERVICE_URL not set, calling the production Bond service", "url", defaultBondURL)
+	return defaultBondURL, nil
 }
 
 func initBond() {
-	url := os.Getenv("BOND_SERVICE_URL")
-	if url == "" {
-		url = defaultBondURL
+	url, err := bondServiceURL()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	verifyPath := os.Getenv("BOND_VERIFY_PATH")
+	if verifyPath == "" {
+		verifyPath = defaultDDDVerifyPath
+	}
+	if !strings.HasPrefix(verifyPath, "/") {
+		log.Fatalf("Invalid BOND_VERIFY_PATH %v (expecting a path starting with /)\n", verifyPath)
+	}
+	verifyBatchPath := os.Getenv("BOND_VERIFY_BATCH_PATH")
+	if verifyBatchPath == "" {
+		verifyBatchPath = defaultDDDVerifyBatchPath
+	}
+	if !strings.HasPrefix(verifyBatchPath, "/") {
+		log.Fatalf("Invalid BOND_VERIFY_BATCH_PATH %v (expecting a path starting with /)\n", verifyBatchPath)
+	}
+	verifyMethod := strings.ToUpper(os.Getenv("BOND_VERIFY_METHOD"))
+	if verifyMethod == "" {
+		verifyMethod = http.MethodPost
+	}
+	if _, ok := bondMethods[verifyMethod]; !ok {
+		log.Fatalf("Invalid BOND_VERIFY_METHOD %v (expecting GET, POST or PUT)\n", os.Getenv("BOND_VERIFY_METHOD"))
+	}
+
+	tlsConfig, err := bondTLSConfig()
+	if err != nil {
+		log.Fatalf("Invalid Bond TLS configuration: %v\n", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxIdleConnsPerHost = bondMaxIdleConns
+
+	// One deadline per attempt, so running out of time is always a bondTimeoutError.
+	// BOND_TIMEOUT_S takes precedence over BOND_HTTP_TIMEOUT_S.
+	timeout, err := envSeconds("BOND_HTTP_TIMEOUT_S", defaultBondHTTPTimeout)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if timeout, err = envSeconds("BOND_TIMEOUT_S", timeout); err != nil {
+		log.Fatalln(err)
+	}
+
+	maxRetries := defaultBondMaxRetries
+	if v := os.Getenv("BOND_MAX_RETRIES"); v != "" {
+		maxRetries, err = strconv.Atoi(v)
+		if err != nil || maxRetries < 0 {
+			log.Fatalf("Invalid BOND_MAX_RETRIES %v\n", v)
+		}
+	}
+	baseDelay := defaultBondRetryBaseDelay
+	if v := os.Getenv("BOND_RETRY_BASE_DELAY_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			log.Fatalf("Invalid BOND_RETRY_BASE_DELAY_MS %v\n", v)
+		}
+		baseDelay = time.Duration(ms) * time.Millisecond
+	}
+
+	var tokenSource oauth2.TokenSource
+	if os.Getenv("BOND_AUTH") == "true" {
+		// Cloud Run checks the token's audience against the service URL
+		tokenSource, err = idtoken.NewTokenSource(context.Background(), url)
+		if err != nil {
+			log.Fatalf("Could not get ID tokens for Bond: %v\n", err)
+		}
 	}
 
 	bondCfg = bondConfig{
-		BondURL: url,
+		BondURL:          url,
+		VerifyPath:       verifyPath,
+		VerifyBatchPath:  verifyBatchPath,
+		VerifyMethod:     verifyMethod,
+		ForwardParams:    envList("BOND_FORWARD_PARAMS", ""),
+		ValidateResponse: os.Getenv("BOND_VALIDATE_RESPONSE") == "true",
+		Client:           &http.Client{Transport: transport},
+		Timeout:          timeout,
+		MaxRetries:       maxRetries,
+		RetryBaseDelay:   baseDelay,
+		TokenSource:      tokenSource,
 	}
 
 }
 
-// Sends a JSON request as a POST body to bond and returns the raw bytes from the response
-func sendJson(ctx context.Context, endpoint string, body any) (b []byte, err error) {
-	// Marshall
-	bodyBytes, err := json.Marshal(body)
-	if err != nil {
-		return b, err
+// Whether SKIP_BOND asks the app to answer without verifying with Bond, for
+// local development and load testing the database without depending on Bond
+func skipBond() bool {
+	return os.Getenv("SKIP_BOND") == "true"
+}
+
+// TLS settings for connections to Bond.
+// BOND_TLS_MIN_VERSION is 1.2 (default) or 1.3, BOND_TLS_CIPHER_SUITES optionally restricts the
+// TLS 1.2 cipher suites to a comma separated list of Go names (TLS 1.3 suites are not configurable).
+// For Bond behind mTLS, BOND_TLS_CLIENT_CERT and BOND_TLS_CLIENT_KEY are the PEM files of the client
+// certificate to present, and BOND_TLS_CA optionally replaces the system roots that Bond's server
+// certificate is checked against.
+func bondTLSConfig() (*tls.Config, error) {
+	c := &tls.Config{}
+	switch os.Getenv("BOND_TLS_MIN_VERSION") {
+	case "", "1.2":
+		c.MinVersion = tls.VersionTLS12
+	case "1.3":
+		c.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported BOND_TLS_MIN_VERSION %v (expecting 1.2 or 1.3)", os.Getenv("BOND_TLS_MIN_VERSION"))
 	}
-	url := bondCfg.BondURL + endpoint
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(bodyBytes))
-	if err != nil {
+
+	if suites := os.Getenv("BOND_TLS_CIPHER_SUITES"); suites != "" {
+		ids := map[string]uint16{}
+		for _, s := range tls.CipherSuites() {
+			ids[s.Name] = s.ID
+		}
+		for _, name := range strings.Split(suites, ",") {
+			id, ok := ids[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %v in BOND_TLS_CIPHER_SUITES", name)
+			}
+			c.CipherSuites = append(c.CipherSuites, id)
+		}
+	}
+
+	certFile, keyFile := os.Getenv("BOND_TLS_CLIENT_CERT"), os.Getenv("BOND_TLS_CLIENT_KEY")
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("BOND_TLS_CLIENT_CERT and BOND_TLS_CLIENT_KEY must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate in BOND_TLS_CLIENT_CERT and BOND_TLS_CLIENT_KEY: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if caFile := os.Getenv("BOND_TLS_CA"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read BOND_TLS_CA: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in BOND_TLS_CA %v", caFile)
+		}
+	}
+	return c, nil
+}
+
+const (
+	// Limit on each attempt to reach Bond, including reading the response
+	defaultBondHTTPTimeout = 30 * time.Second
+	// Idle connections kept open to Bond
+	bondMaxIdleConns = 10
+	// Retries after the first attempt when Bond can't be reached or fails
+	defaultBondMaxRetries = 3
+	// Backoff before the first retry, doubled for each further retry
+	defaultBondRetryBaseDelay = 200 * time.Millisecond
+	// Wait before retrying when Bond sends a Retry-After we can't parse
+	defaultRetryAfter = time.Second
+	// Longest we will wait between attempts
+	maxRetryAfter = 30 * time.Second
+)
+
+// Methods Bond can be called with, and whether the body is sent as query parameters rather than
+// as JSON
+var bondMethods = map[string]bool{
+	http.MethodGet:  true,
+	http.MethodPost: false,
+	http.MethodPut:  false,
+}
+
+// Sends a JSON request as a POST body to bond and returns the raw bytes from the response, see
+// callBond
+func sendJson(ctx context.Context, endpoint string, body any) ([]byte, error) {
+	return callBond(ctx, http.MethodPost, endpoint, body)
+}
+
+// Calls bond's endpoint with method and returns the raw bytes from the response. POST and PUT send
+// body as JSON, while GET sends its fields as query parameters (see bondQuery) and any headers
+// withBondParamHeaders added to ctx.
+// A non-2xx response returns its body along with a *BondError.
+// Connection errors, 5xx and 429 responses are retried up to bondCfg.MaxRetries times with
+// exponential backoff and jitter, or after the Retry-After delay if Bond sends one. Any other
+// non-2xx response fails immediately. An attempt that runs past bondCfg.Timeout fails with a
+// *bondTimeoutError and is retried like a connection error.
+func callBond(ctx context.Context, method, endpoint string, body any) (b []byte, err error) {
+	inQuery, ok := bondMethods[method]
+	if !ok {
+		return b, fmt.Errorf("unsupported method %v for Bond (expecting GET, POST or PUT)", method)
+	}
+	target := bondCfg.BondURL + endpoint
+	var bodyBytes []byte
+	if inQuery {
+		q, err := bondQuery(body)
+		if err != nil {
+			return b, err
+		}
+		if len(q) > 0 {
+			sep := "?"
+			if strings.Contains(target, "?") {
+				sep = "&"
+			}
+			target += sep + q.Encode()
+		}
+	} else if bodyBytes, err = json.Marshal(body); err != nil {
 		return b, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	client := http.Client{}
-	res, err := client.Do(req)
+	// The span leaves out the query, which for a GET carries the result
+	spanURL, _, _ := strings.Cut(target, "?")
+	ctx, span := tracer().Start(ctx, "bond "+endpoint, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(method), semconv.HTTPURLKey.String(spanURL)))
+	start := time.Now()
+	defer func() {
+		observeBond(endpoint, start, err)
+		endSpan(span, err)
+	}()
+	// Each attempt gets its own deadline, cancelled before the next attempt or on return
+	cancelAttempt := context.CancelFunc(func() {})
+	defer func() { cancelAttempt() }()
+	for attempt := 1; ; attempt++ {
+		cancelAttempt()
+		var attemptCtx context.Context
+		attemptCtx, cancelAttempt = bondAttemptContext(ctx)
+		// Whether this attempt, rather than the caller, ran out of time
+		timedOut := func() bool {
+			return ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded)
+		}
+		var reqBody io.Reader
+		if !inQuery {
+			reqBody = bytes.NewReader(bodyBytes)
+		}
+		req, err := http.NewRequestWithContext(attemptCtx, method, target, reqBody)
+		if err != nil {
+			return b, err
+		}
+		if !inQuery {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		setTraceHeaders(ctx, req.Header)
+		if h, ok := ctx.Value(bondHeadersKey{}).(http.Header); ok {
+			for key, v := range h {
+				req.Header[key] = v
+			}
+		}
+		// Our span's traceparent replaces the caller's, so Bond's spans nest under it
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+		if bondCfg.TokenSource != nil {
+			// Tokens are cached until shortly before they expire, so this is usually free
+			tok, err := bondCfg.TokenSource.Token()
+			if err != nil {
+				return b, fmt.Errorf("could not get an ID token for Bond: %w", err)
+			}
+			tok.SetAuthHeader(req)
+		}
+		res, err := bondCfg.Client.Do(req)
+		if err == nil {
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(res.StatusCode), attribute.Int("bond.attempts", attempt))
+		}
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return b, ctx.Err()
+			}
+			if timedOut() {
+				err = &bondTimeoutError{After: bondCfg.Timeout, Err: err}
+			}
+			if attempt > bondCfg.MaxRetries {
+				return b, &bondRequestError{Attempts: attempt, Err: err}
+			}
+			wait = bondBackoff(attempt, bondCfg.RetryBaseDelay)
+			loggerFrom(ctx).Warn("Bond request failed, retrying", "endpoint", endpoint, "error", err, "attempt", attempt, "retry_in_ms", wait.Milliseconds())
+		case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+			if attempt > bondCfg.MaxRetries {
+				return bondError(res, attempt)
+			}
+			res.Body.Close()
+			wait = bondBackoff(attempt, bondCfg.RetryBaseDelay)
+			if h := res.Header.Get("Retry-After"); h != "" {
+				wait = retryAfter(h, time.Now())
+			}
+			loggerFrom(ctx).Warn("Bond request failed, retrying", "endpoint", endpoint, "status", res.StatusCode, "attempt", attempt, "retry_in_ms", wait.Milliseconds())
+		default:
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				return bondError(res, attempt)
+			}
+			defer res.Body.Close()
+			b, err = io.ReadAll(res.Body)
+			if err != nil && timedOut() {
+				err = &bondTimeoutError{After: bondCfg.Timeout, Err: err}
+			}
+			return b, err
+		}
+		select {
+		case <-ctx.Done():
+			return b, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// The query parameters a GET to Bond sends body as: one per field of the JSON object body marshals
+// to, strings as they are and other values as JSON, e.g. total_cents=27500. Null fields and a nil
+// body add none.
+func bondQuery(body any) (url.Values, error) {
+	b, err := json.Marshal(body)
 	if err != nil {
-		return b, err
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("a GET to Bond sends its body as query parameters, so it must be a JSON object: %w", err)
+	}
+	q := url.Values{}
+	for k, v := range fields {
+		var s string
+		switch {
+		case string(v) == "null":
+		case json.Unmarshal(v, &s) == nil:
+			q.Set(k, s)
+		default:
+			q.Set(k, string(v))
+		}
+	}
+	return q, nil
+}
+
+// The query parameters in q that bondCfg.ForwardParams lets through to Bond, the first value of
+// each. Every other parameter is dropped. Nil when there are none.
+func forwardedParams(q url.Values) map[string]string {
+	var params map[string]string
+	for _, name := range bondCfg.ForwardParams {
+		if !q.Has(name) {
+			continue
+		}
+		if params == nil {
+			params = map[string]string{}
+		}
+		params[name] = q.Get(name)
+	}
+	return params
+}
+
+// Prefix of the headers a GET to Bond carries forwarded parameters in, one per parameter, e.g.
+// X-Bond-Param-Player_id. They stay out of the query so they don't reach access logs and traces.
+const bondParamHeaderPrefix = "X-Bond-Param-"
+
+type bondHeadersKey struct{}
+
+// Returns ctx with params added as bondParamHeaderPrefix headers to every request callBond sends
+// under it
+func withBondParamHeaders(ctx context.Context, params map[string]string) context.Context {
+	h := http.Header{}
+	for name, v := range params {
+		h.Set(bondParamHeaderPrefix+name, v)
 	}
-	if res.StatusCode < 200 || res.StatusCode > 299 {
-		return b, fmt.Errorf("expected 200 response")
+	return context.WithValue(ctx, bondHeadersKey{}, h)
+}
+
+// Bond's reply to a verify request, checked when BOND_VALIDATE_RESPONSE is set. Other fields are
+// ignored.
+type BondVerifyResponse struct {
+	// Whether the result checks out. Required, so a reply without it is malformed.
+	Valid *bool `json:"valid"`
+	// Why, usually only set when the result isn't valid
+	Message string `json:"message,omitempty"`
+}
+
+// Decodes Bond's reply to a verify request. Fails with ErrBondUnexpectedReply when it isn't a
+// BondVerifyResponse, and with ErrBondRejected and Bond's message when the result isn't valid.
+func checkVerifyResponse(b []byte) (BondVerifyResponse, error) {
+	var res BondVerifyResponse
+	if err := json.Unmarshal(b, &res); err != nil {
+		return res, fmt.Errorf("%w: expected a JSON object from the verify endpoint: %v", ErrBondUnexpectedReply, err)
+	}
+	if res.Valid == nil {
+		return res, fmt.Errorf("%w: no \"valid\" in the verify reply", ErrBondUnexpectedReply)
 	}
+	if !*res.Valid {
+		if res.Message == "" {
+			return res, ErrBondRejected
+		}
+		return res, fmt.Errorf("%w: %v", ErrBondRejected, truncate(res.Message, maxBondErrorMessage))
+	}
+	return res, nil
+}
 
-	b, err = io.ReadAll(res.Body)
+// Checks Bond's reply to a verify request with checkVerifyResponse when BOND_VALIDATE_RESPONSE is
+// set, so every caller fails the same replies. Without it any reply passes.
+func checkVerifyReply(b []byte) error {
+	if !bondCfg.ValidateResponse {
+		return nil
+	}
+	_, err := checkVerifyResponse(b)
+	return err
+}
+
+// Bond's verdict on one item of a batch
+type bondBatchResult struct {
+	// Bond's reply for the item
+	Body json.RawMessage
+	// A *BondError when Bond failed the item, or an error when it sent nothing for it
+	Err error
+}
+
+// Sends items to bond as one JSON array, so verifying several results costs a single request, and
+// returns Bond's verdict on each in the same order. Bond replies with an array holding an object
+// per item, and an item whose "status" is outside 2xx failed with that status. An item without a
+// "status" passed. The request as a whole is retried and fails like sendJson's. Items failing
+// don't fail the batch, but a reply that isn't an array does.
+func sendJsonBatch(ctx context.Context, endpoint string, items []any) ([]bondBatchResult, error) {
+	b, err := sendJson(ctx, endpoint, items)
 	if err != nil {
-		return b, err
+		return nil, err
+	}
+	var replies []json.RawMessage
+	if err := json.Unmarshal(b, &replies); err != nil {
+		return nil, fmt.Errorf("%w: expected a JSON array from the batch endpoint: %v", ErrBondUnexpectedReply, err)
+	}
+	results := make([]bondBatchResult, len(items))
+	for i := range results {
+		if i >= len(replies) {
+			results[i].Err = fmt.Errorf("%w: no result for item %v of %v", ErrBondUnexpectedReply, i+1, len(items))
+			continue
+		}
+		results[i].Body = replies[i]
+		var item struct {
+			Status int `json:"status"`
+		}
+		if err := json.Unmarshal(replies[i], &item); err != nil {
+			results[i].Err = fmt.Errorf("%w: item %v is not a JSON object: %v", ErrBondUnexpectedReply, i+1, err)
+			continue
+		}
+		if item.Status != 0 && (item.Status < 200 || item.Status > 299) {
+			results[i].Err = &BondError{StatusCode: item.Status, Body: replies[i], Attempts: 1}
+		}
+	}
+	return results, nil
+}
+
+// The context for one attempt at a Bond request, with bondCfg.Timeout as its deadline if set
+func bondAttemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if bondCfg.Timeout > 0 {
+		return context.WithTimeout(ctx, bondCfg.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Most of an error response's body kept in a BondError
+const maxBondErrorBody = 4 << 10
+
+// Reads and closes an error response, returning its body along with a *BondError
+func bondError(res *http.Response, attempts int) ([]byte, error) {
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxBondErrorBody))
+	return body, &BondError{StatusCode: res.StatusCode, Body: body, Attempts: attempts}
+}
+
+// Exponential backoff with jitter before retry number attempt: a random delay between half and all
+// of base * 2^(attempt-1), so clients that failed together don't all retry together
+func bondBackoff(attempt int, base time.Duration) time.Duration {
+	d := base << (attempt - 1)
+	if d <= 0 || d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// How long to wait according to a Retry-After header, which is either seconds or an HTTP date
+func retryAfter(header string, now time.Time) time.Duration {
+	wait := defaultRetryAfter
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		wait = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		wait = t.Sub(now)
+		if wait < 0 {
+			wait = 0
+		}
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
 	}
-	return b, nil
+	return wait
 }
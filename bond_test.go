@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"golang.org/x/exp/slog"
+	"golang.org/x/oauth2"
+)
+
+// Points Bond at a test server for the duration of a test
+func stubBond(t *testing.T, handler http.HandlerFunc) {
+	srv := httptest.NewServer(handler)
+	orig := bondCfg
+	bondCfg = bondConfig{
+		BondURL:         srv.URL,
+		VerifyPath:      defaultDDDVerifyPath,
+		VerifyBatchPath: defaultDDDVerifyBatchPath,
+		VerifyMethod:    http.MethodPost,
+		Client:          &http.Client{},
+		MaxRetries:      defaultBondMaxRetries,
+		RetryBaseDelay:  time.Millisecond,
+	}
+	t.Cleanup(func() {
+		bondCfg = orig
+		srv.Close()
+	})
+}
+
+func Test_SendJsonRetryAfter(t *testing.T) {
+	var calls int32
+	stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	})
+
+	start := time.Now()
+	b, err := sendJson(context.Background(), "/v1/test", map[string]string{"a": "b"})
+	if err != nil {
+		t.Fatalf("sendJson error = %v, expected nil", err)
+	}
+	if string(b) != `{"ok":true}` {
+		t.Errorf("sendJson = %s, expected the body of the retried request", b)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("sendJson made %d calls, expected 2", got)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("sendJson retried after %v, expected it to honour Retry-After: 1", elapsed)
+	}
+}
+
+func Test_CallBond(t *testing.T) {
+	payload := struct {
+		MagicCoffee string   `json:"magic_coffee"`
+		TotalCents  int64    `json:"total_cents"`
+		Empty       bool     `json:"empty"`
+		Tags        []string `json:"tags"`
+		Note        *string  `json:"note"`
+	}{MagicCoffee: "Fake 50", TotalCents: 27500, Tags: []string{"decaf"}}
+
+	tests := []struct {
+		name      string
+		method    string
+		endpoint  string
+		body      any
+		wantQuery string
+		wantBody  string
+		wantErr   bool
+	}{
+		{name: "GET", method: http.MethodGet, endpoint: "/v1/test", body: payload, wantQuery: "empty=false&magic_coffee=Fake+50&tags=%5B%22decaf%22%5D&total_cents=27500"},
+		{name: "GET without a body", method: http.MethodGet, endpoint: "/v1/test"},
+		{name: "GET with a query of its own", method: http.MethodGet, endpoint: "/v1/test?v=2", body: map[string]int{"n": 1}, wantQuery: "v=2&n=1"},
+		{name: "POST", method: http.MethodPost, endpoint: "/v1/test", body: payload, wantBody: `{"magic_coffee":"Fake 50","total_cents":27500,"empty":false,"tags":["decaf"],"note":null}`},
+		{name: "PUT", method: http.MethodPut, endpoint: "/v1/test", body: map[string]int{"n": 1}, wantBody: `{"n":1}`},
+		{name: "GET with an array", method: http.MethodGet, endpoint: "/v1/test", body: []int{1}, wantErr: true},
+		{name: "unsupported method", method: http.MethodDelete, endpoint: "/v1/test", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			var gotBody []byte
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				gotBody, _ = io.ReadAll(r.Body)
+				w.Write([]byte(`{"ok":true}`))
+			})
+
+			b, err := callBond(context.Background(), tt.method, tt.endpoint, tt.body)
+			if tt.wantErr {
+				if err == nil || got != nil {
+					t.Errorf("callBond error = %v, expected an error without calling Bond", err)
+				}
+				return
+			}
+			if err != nil || string(b) != `{"ok":true}` {
+				t.Fatalf("callBond = %s, %v, expected Bond's reply", b, err)
+			}
+			if got.Method != tt.method || got.URL.Path != "/v1/test" || got.URL.RawQuery != tt.wantQuery {
+				t.Errorf("Bond got %v %v, expected %v /v1/test?%v", got.Method, got.URL, tt.method, tt.wantQuery)
+			}
+			if string(gotBody) != tt.wantBody {
+				t.Errorf("Bond got body %q, expected %q", gotBody, tt.wantBody)
+			}
+			wantType := ""
+			if tt.wantBody != "" {
+				wantType = "application/json"
+			}
+			if got.Header.Get("Content-Type") != wantType {
+				t.Errorf("Content-Type = %q, expected %q", got.Header.Get("Content-Type"), wantType)
+			}
+		})
+	}
+}
+
+func Test_SendJsonBadRequest(t *testing.T) {
+	var calls int32
+	stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "bad payload", http.StatusBadRequest)
+	})
+
+	_, err := sendJson(context.Background(), "/v1/test", nil)
+	var bondErr *BondError
+	if !errors.As(err, &bondErr) || !errors.Is(err, ErrBondUnexpectedStatus) {
+		t.Fatalf("sendJson error = %v, expected a *BondError", err)
+	}
+	if bondErr.StatusCode != http.StatusBadRequest || string(bondErr.Body) != "bad payload\n" {
+		t.Errorf("BondError = %+v, expected the 400 status and body", bondErr)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("sendJson made %d calls, expected 1 (no retry on 400)", got)
+	}
+}
+
+func Test_SendJsonBackoff(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int32
+		status    int
+		wantErr   bool
+		wantCalls int32
+	}{
+		{name: "recovers from 500s", failures: 2, status: http.StatusInternalServerError, wantCalls: 3},
+		{name: "recovers from connection errors", failures: 2, wantCalls: 3},
+		{name: "gives up", failures: 10, status: http.StatusBadGateway, wantErr: true, wantCalls: defaultBondMaxRetries + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) <= tt.failures {
+					if tt.status == 0 {
+						// Drop the connection without a response
+						conn, _, _ := w.(http.Hijacker).Hijack()
+						conn.Close()
+						return
+					}
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Write([]byte(`{"ok":true}`))
+			})
+
+			_, err := sendJson(context.Background(), "/v1/test", nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendJson error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "502") {
+				t.Errorf("sendJson error = %v, expected it to include the last status", err)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("sendJson made %d calls, expected %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_SendJsonTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		// How long Bond takes to answer each attempt
+		delays    []time.Duration
+		wantErr   bool
+		wantCalls int32
+	}{
+		{name: "fast enough", delays: []time.Duration{0}, wantCalls: 1},
+		{name: "recovers from a slow attempt", delays: []time.Duration{200 * time.Millisecond, 0}, wantCalls: 2},
+		{name: "always slow", delays: []time.Duration{200 * time.Millisecond, 200 * time.Millisecond}, wantErr: true, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(tt.delays[n-1]):
+				}
+				w.Write([]byte(`{"ok":true}`))
+			})
+			bondCfg.Timeout = 50 * time.Millisecond
+			bondCfg.MaxRetries = 1
+
+			start := time.Now()
+			_, err := sendJson(context.Background(), "/v1/test", nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendJson error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrBondTimeout) || errorStatus(err) != http.StatusGatewayTimeout {
+					t.Errorf("sendJson error = %v (status %v), expected %v and a 504", err, errorStatus(err), ErrBondTimeout)
+				}
+				if elapsed := time.Since(start); elapsed > 350*time.Millisecond {
+					t.Errorf("sendJson took %v, expected each attempt to stop at BOND_TIMEOUT_S", elapsed)
+				}
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("sendJson made %d calls, expected %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_SendJsonBatch(t *testing.T) {
+	items := []any{DDDBondPayload{Total: 1}, DDDBondPayload{Total: 2}, DDDBondPayload{Total: 3}}
+	tests := []struct {
+		name  string
+		reply string
+		// Status of each item's BondError, 0 when it passed and -1 for any other error
+		want    []int
+		wantErr error
+	}{
+		{name: "all pass", reply: `[{"ok":true},{"ok":true,"status":200},{"ok":true}]`, want: []int{0, 0, 0}},
+		{name: "mixed", reply: `[{"ok":true},{"status":400,"error":"wrong total"},{"status":200}]`, want: []int{0, 400, 0}},
+		{name: "short reply", reply: `[{"ok":true},{"status":422}]`, want: []int{0, 422, -1}},
+		{name: "item not an object", reply: `[{"ok":true},"ok",{}]`, want: []int{0, -1, 0}},
+		{name: "not an array", reply: `{"ok":true}`, wantErr: ErrBondUnexpectedReply},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []DDDBondPayload
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&sent)
+				w.Write([]byte(tt.reply))
+			})
+			got, err := sendJsonBatch(context.Background(), defaultDDDVerifyBatchPath, items)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("sendJsonBatch error = %v, expected %v", err, tt.wantErr)
+			}
+			if len(sent) != len(items) {
+				t.Errorf("Bond got %+v, expected all %v items in one array", sent, len(items))
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			for i, want := range tt.want {
+				var bondErr *BondError
+				switch {
+				case want == 0 && got[i].Err != nil,
+					want > 0 && !(errors.As(got[i].Err, &bondErr) && bondErr.StatusCode == want),
+					want < 0 && !errors.Is(got[i].Err, ErrBondUnexpectedReply):
+					t.Errorf("item %v error = %v, expected status %v", i, got[i].Err, want)
+				}
+			}
+		})
+	}
+}
+
+// Counts the requests made through it
+type countingTransport struct {
+	requests int32
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func Test_SendJsonSharedClient(t *testing.T) {
+	stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(`{"ok":true}`))
+	})
+	transport := &countingTransport{}
+	bondCfg.Client = &http.Client{Transport: transport}
+	bondCfg.Timeout = 50 * time.Millisecond
+	bondCfg.MaxRetries = 0
+
+	for i := 0; i < 3; i++ {
+		if _, err := sendJson(context.Background(), "/v1/test", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(&transport.requests); got != 3 {
+		t.Errorf("shared client made %d requests, expected 3", got)
+	}
+
+	start := time.Now()
+	if _, err := sendJson(context.Background(), "/v1/slow", nil); !errors.Is(err, ErrBondTimeout) {
+		t.Errorf("sendJson error = %v, expected %v", err, ErrBondTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("sendJson took %v, expected it to give up after the 50ms timeout", elapsed)
+	}
+}
+
+func Test_SendJsonTraceHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	})
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{
+			name:    "cloud trace",
+			headers: map[string]string{"X-Cloud-Trace-Context": "105445aa7843bc8bf206b12000100000/1;o=1"},
+		},
+		{
+			name: "w3c",
+			headers: map[string]string{
+				"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+				"tracestate":  "congo=t61rcWkgMzE",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := middleware.RequestID(traceContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, err := sendJson(r.Context(), "/v1/test", nil); err != nil {
+					t.Fatal(err)
+				}
+			})))
+			req := httptest.NewRequest(http.MethodPost, "/data_driven_decaf", nil)
+			req.Header.Set(middleware.RequestIDHeader, "order-42")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			got := <-received
+			for k, v := range tt.headers {
+				if got.Get(k) != v {
+					t.Errorf("Bond got %v %q, expected %q", k, got.Get(k), v)
+				}
+			}
+			if got.Get(middleware.RequestIDHeader) != "order-42" {
+				t.Errorf("Bond got request ID %q, expected order-42", got.Get(middleware.RequestIDHeader))
+			}
+		})
+	}
+}
+
+func Test_BondBackoff(t *testing.T) {
+	base := 100 * time.Millisecond
+	for attempt := 1; attempt <= 4; attempt++ {
+		max := base << (attempt - 1)
+		if got := bondBackoff(attempt, base); got < max/2 || got > max {
+			t.Errorf("bondBackoff(%v) = %v, expected between %v and %v", attempt, got, max/2, max)
+		}
+	}
+	if got := bondBackoff(40, base); got > maxRetryAfter {
+		t.Errorf("bondBackoff(40) = %v, expected at most %v", got, maxRetryAfter)
+	}
+}
+
+func Test_RetryAfter(t *testing.T) {
+	now := time.Date(2023, 3, 14, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{header: "", want: defaultRetryAfter},
+		{header: "5", want: 5 * time.Second},
+		{header: "3600", want: maxRetryAfter},
+		{header: now.Add(10 * time.Second).Format(http.TimeFormat), want: 10 * time.Second},
+		{header: "soon", want: defaultRetryAfter},
+	}
+	for _, tt := range tests {
+		if got := retryAfter(tt.header, now); got != tt.want {
+			t.Errorf("retryAfter(%q) = %v, expected %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func Test_BondServiceURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		strict      string
+		want        string
+		wantErr     bool
+		wantWarning bool
+	}{
+		{name: "set", url: "https://bond.example.com", want: "https://bond.example.com"},
+		{name: "set and strict", url: "https://bond.example.com", strict: "true", want: "https://bond.example.com"},
+		{name: "default", want: defaultBondURL, wantWarning: true},
+		{name: "strict", strict: "true", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			orig := slog.Default()
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&buf)))
+			t.Cleanup(func() { slog.SetDefault(orig) })
+			t.Setenv("BOND_SERVICE_URL", tt.url)
+			t.Setenv("BOND_REQUIRE_EXPLICIT", tt.strict)
+
+			got, err := bondServiceURL()
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("bondServiceURL = %q, %v, expected %q, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+			if warned := strings.Contains(buf.String(), `"level":"WARN"`); warned != tt.wantWarning {
+				t.Errorf("warned %v, expected %v: %s", warned, tt.wantWarning, buf.String())
+			}
+		})
+	}
+}
+
+func Test_BondVerifyPath(t *testing.T) {
+	orig := bondCfg
+	t.Cleanup(func() { bondCfg = orig })
+	t.Setenv("BOND_VERIFY_PATH", "/v2/mock/verify")
+	initBond()
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Path
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	bondCfg.BondURL = srv.URL
+	stubDDDConnect(t, func(ctx context.Context, dbType string) (DDDBondPayload, error) {
+		return DDDBondPayload{Total: 1, RowCount: 1}, nil
+	})
+
+	rec := httptest.NewRecorder()
+	dddHandler(rec, httptest.NewRequest(http.MethodGet, "/data_driven_decaf/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %v, expected %v (body %s)", rec.Code, http.StatusOK, rec.Body)
+	}
+	if got != "/v2/mock/verify" {
+		t.Errorf("Bond request path = %q, expected %q", got, "/v2/mock/verify")
+	}
+}
+
+func Test_BondTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		httpTimeout string
+		timeout     string
+		want        time.Duration
+	}{
+		{name: "default", want: defaultBondHTTPTimeout},
+		{name: "http timeout", httpTimeout: "10", want: 10 * time.Second},
+		{name: "timeout", timeout: "5", want: 5 * time.Second},
+		{name: "timeout takes precedence", httpTimeout: "10", timeout: "5", want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := bondCfg
+			t.Cleanup(func() { bondCfg = orig })
+			t.Setenv("BOND_HTTP_TIMEOUT_S", tt.httpTimeout)
+			t.Setenv("BOND_TIMEOUT_S", tt.timeout)
+			initBond()
+			if bondCfg.Timeout != tt.want || bondCfg.Client.Timeout != 0 {
+				t.Errorf("attempt timeout = %v, client timeout = %v, expected %v and none", bondCfg.Timeout, bondCfg.Client.Timeout, tt.want)
+			}
+		})
+	}
+}
+
+func Test_SendJsonIDToken(t *testing.T) {
+	var got string
+	stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+	})
+
+	sendJson(context.Background(), "/v1/test", nil)
+	if got != "" {
+		t.Errorf("Authorization = %q without BOND_AUTH, expected none", got)
+	}
+
+	bondCfg.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "id-token", TokenType: "Bearer"})
+	if _, err := sendJson(context.Background(), "/v1/test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got != "Bearer id-token" {
+		t.Errorf("Authorization = %q, expected %q", got, "Bearer id-token")
+	}
+}
+
+func Test_SendJsonErrorBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			name:        "html",
+			contentType: "text/html; charset=utf-8",
+			body:        "<html><head><title>500 Internal Server Error</title></head>\n<body><h1>Server Error</h1>\n<p>The server hit a snag.</p></body></html>",
+			want:        "expected 200 response, got 500 after 4 attempts: 500 Internal Server Error Server Error The server hit a snag.",
+		},
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        "{\n  \"error\": \"magic coffee mismatch\",\n  \"code\": 17\n}",
+			want:        `expected 200 response, got 500 after 4 attempts: {"error":"magic coffee mismatch","code":17}`,
+		},
+		{
+			name:        "large",
+			contentType: "text/plain",
+			body:        strings.Repeat("é", maxBondErrorMessage),
+			want:        "expected 200 response, got 500 after 4 attempts: " + strings.Repeat("é", maxBondErrorMessage/2) + "... (truncated)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(tt.body))
+			})
+			_, err := sendJson(context.Background(), "/v1/test", nil)
+			if !errors.Is(err, ErrBondUnexpectedStatus) {
+				t.Fatalf("sendJson error = %v, expected %v", err, ErrBondUnexpectedStatus)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("sendJson error = %q, expected %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Writes a new self-signed client certificate and its key as PEM files in dir
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cymbal-coffee-backend"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func Test_BondClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, clientCert := writeClientCert(t, dir)
+
+	// Bond behind mTLS, only accepting our client certificate
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	serverCA := filepath.Join(dir, "bond-ca.pem")
+	if err := os.WriteFile(serverCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		cert       string
+		key        string
+		ca         string
+		wantConfig bool
+		wantErr    bool
+	}{
+		{name: "client certificate", cert: certFile, key: keyFile, ca: serverCA, wantConfig: true},
+		{name: "no client certificate", ca: serverCA, wantConfig: true, wantErr: true},
+		{name: "server not trusted", cert: certFile, key: keyFile, wantConfig: true, wantErr: true},
+		{name: "certificate without key", cert: certFile, ca: serverCA},
+		{name: "missing certificate", cert: filepath.Join(dir, "missing.pem"), key: keyFile},
+		{name: "key doesn't match", cert: certFile, key: certFile},
+		{name: "missing CA", ca: filepath.Join(dir, "missing.pem")},
+		{name: "CA not PEM", ca: notPEM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BOND_TLS_CLIENT_CERT", tt.cert)
+			t.Setenv("BOND_TLS_CLIENT_KEY", tt.key)
+			t.Setenv("BOND_TLS_CA", tt.ca)
+			c, err := bondTLSConfig()
+			if (err == nil) != tt.wantConfig {
+				t.Fatalf("bondTLSConfig error = %v, expected a config %v", err, tt.wantConfig)
+			}
+			if !tt.wantConfig {
+				return
+			}
+
+			orig := bondCfg
+			t.Cleanup(func() { bondCfg = orig })
+			bondCfg = bondConfig{BondURL: srv.URL, Client: &http.Client{Transport: &http.Transport{TLSClientConfig: c}}}
+			_, err = sendJson(context.Background(), "/v1/test", nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sendJson error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Adds rows to the coffee table, so the service can be tested end to end
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	mssql "github.com/microsoft/go-mssqldb"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const maxCoffeeBodyBytes = 4 << 10
+
+type newCoffeeRequest struct {
+	Bean  string `json:"bean"`
+	Price string `json:"price"`
+}
+
+// The part of *pgxpool.Pool used to insert coffee, so tests can substitute pgxmock
+type pgxRowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// MySQL errors for rows that break a constraint: duplicate key, NULL or missing value, foreign key
+// and check constraint violations
+var mySQLConstraintErrors = map[uint16]bool{1048: true, 1062: true, 1364: true, 1451: true, 1452: true, 3819: true}
+
+// SQL Server errors for rows that break a constraint: NULL value, foreign key or check constraint,
+// and duplicate key in a unique index or constraint
+var sqlServerConstraintErrors = map[int32]bool{515: true, 547: true, 2601: true, 2627: true}
+
+// Wraps errors from a row that breaks a table constraint (e.g. a duplicate id) with ErrCoffeeConflict
+func coffeeConflict(err error) error {
+	var (
+		pgErr     *pgconn.PgError
+		mySQLErr  *mysql.MySQLError
+		mssqlErr  mssql.Error
+		sqliteErr *sqlite.Error
+	)
+	switch {
+	// Class 23 is integrity constraint violations
+	case errors.As(err, &pgErr) && strings.HasPrefix(pgErr.Code, "23"),
+		errors.As(err, &mySQLErr) && mySQLConstraintErrors[mySQLErr.Number],
+		errors.As(err, &mssqlErr) && sqlServerConstraintErrors[mssqlErr.Number],
+		errors.As(err, &sqliteErr) && sqliteErr.Code()&0xff == sqlite3.SQLITE_CONSTRAINT:
+		return fmt.Errorf("%w: %v", ErrCoffeeConflict, err)
+	}
+	return err
+}
+
+// Inserts a coffee into Postgres, which assigns its id
+func insertCoffeePostgres(ctx context.Context, pool pgxRowQuerier, c Coffee) (Coffee, error) {
+	s, err := coffeeInsertSchema(dialectPostgres)
+	if err != nil {
+		return c, err
+	}
+	query := fmt.Sprintf("insert into %v (%v, %v) values ($1, $2) returning %v", s.Table, s.Bean, s.Price, s.ID)
+	err = pool.QueryRow(ctx, query, c.Bean, c.Price.Text).Scan(&c.ID)
+	return c, coffeeConflict(err)
+}
+
+// Inserts a coffee into MySQL or SQLite, which assign its id
+func insertCoffeeSQL(ctx context.Context, db *sql.DB, c Coffee) (Coffee, error) {
+	s, err := coffeeInsertSchema(dialectMySQL)
+	if err != nil {
+		return c, err
+	}
+	query := fmt.Sprintf("insert into %v (%v, %v) values (?, ?)", s.Table, s.Bean, s.Price)
+	res, err := db.ExecContext(ctx, query, c.Bean, c.Price.Text)
+	if err != nil {
+		return c, coffeeConflict(err)
+	}
+	c.ID, err = res.LastInsertId()
+	return c, err
+}
+
+// Inserts a coffee into SQL Server, which assigns its id
+func insertCoffeeSQLServer(ctx context.Context, db *sql.DB, c Coffee) (Coffee, error) {
+	s, err := coffeeInsertSchema(dialectSQLServer)
+	if err != nil {
+		return c, err
+	}
+	query := fmt.Sprintf("insert into %v (%v, %v) output inserted.%v values (@p1, @p2)", s.Table, s.Bean, s.Price, s.ID)
+	err = db.QueryRowContext(ctx, query, c.Bean, c.Price.Text).Scan(&c.ID)
+	return c, coffeeConflict(err)
+}
+
+// Inserts a coffee on the given DB type using its shared pool
+func insertCoffee(ctx context.Context, engine string, c Coffee) (Coffee, error) {
+	switch engine {
+	case "ALLOY_DB", "CLOUD_SQL_POSTGRES":
+		pool, err := sharedPostgresPool(ctx, engine)
+		if err != nil {
+			return c, err
+		}
+		return insertCoffeePostgres(ctx, pool, c)
+	case "CLOUD_SQL_MYSQL", "SQLITE":
+		db, err := sharedSQLDB(ctx, engine)
+		if err != nil {
+			return c, err
+		}
+		return insertCoffeeSQL(ctx, db, c)
+	case "CLOUD_SQL_SQLSERVER":
+		db, err := sharedSQLDB(ctx, engine)
+		if err != nil {
+			return c, err
+		}
+		return insertCoffeeSQLServer(ctx, db, c)
+	case "FAKE":
+		return c, fmt.Errorf("the FAKE DB type is read-only")
+	default:
+		return c, fmt.Errorf("%w %v", ErrUnknownDBType, engine)
+	}
+}
+
+// Adds a coffee to the configured database, responding with the new row
+func newCoffeeHandler(w http.ResponseWriter, r *http.Request) {
+	l := loggerFrom(r.Context())
+	engine := os.Getenv("DB_TYPE")
+
+	var req newCoffeeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCoffeeBodyBytes)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, v2Error{Error: "invalid request body"})
+		return
+	}
+	if strings.TrimSpace(req.Bean) == "" {
+		writeJSON(w, http.StatusBadRequest, v2Error{Error: "bean is required"})
+		return
+	}
+	price := parsePrice(strings.TrimSpace(req.Price))
+	if !price.Valid {
+		writeJSON(w, http.StatusBadRequest, v2Error{Error: fmt.Sprintf("price %q is not a number", req.Price)})
+		return
+	}
+
+	c, err := insertCoffee(r.Context(), engine, Coffee{Bean: req.Bean, Price: price})
+	if errors.Is(err, ErrCoffeeConflict) {
+		l.Warn("Coffee: Insert conflicts with an existing row", "db_type", engine, "error", err)
+		writeJSON(w, http.StatusConflict, v2Error{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		l.Error("Coffee: Could not insert", "db_type", engine, "error", err)
+		writeJSON(w, http.StatusInternalServerError, v2Error{Error: err.Error()})
+		return
+	}
+	admin, _ := r.Context().Value(adminIdentityKey{}).(string)
+	l.Info("Coffee: Inserted", "db_type", engine, "id", c.ID, "admin", admin)
+	writeJSON(w, http.StatusCreated, c)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgconn"
+	mssqldb "github.com/microsoft/go-mssqldb"
+	"github.com/pashagolub/pgxmock"
+)
+
+func Test_NewCoffeeHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coffee.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("create table coffee (id integer primary key, bean text unique, price text)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	useDBType(t, "SQLITE")
+	t.Setenv("DB_PATH", path)
+	t.Cleanup(closePools)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		want       Coffee
+	}{
+		{
+			name:       "created",
+			body:       `{"bean":"Arabica","price":"3.50"}`,
+			wantStatus: http.StatusCreated,
+			want:       Coffee{ID: 1, Bean: "Arabica", Price: parsePrice("3.50")},
+		},
+		{
+			name:       "next id",
+			body:       `{"bean":"Robusta","price":" 2 "}`,
+			wantStatus: http.StatusCreated,
+			want:       Coffee{ID: 2, Bean: "Robusta", Price: parsePrice("2")},
+		},
+		{
+			name:       "duplicate",
+			body:       `{"bean":"Arabica","price":"4.00"}`,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "missing bean",
+			body:       `{"price":"4.00"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "price not a number",
+			body:       `{"bean":"Liberica","price":"free"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid json",
+			body:       `{"bean":`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			newCoffeeHandler(rec, httptest.NewRequest(http.MethodPost, "/coffee", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %v, expected %v (body %s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+			var got Coffee
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("coffee = %+v, expected %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_InsertCoffeePostgres(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(`insert into "coffee"`).WithArgs("Arabica", "3.50").
+		WillReturnRows(pgxmock.NewRows([]string{"id"}).AddRow(int64(7)))
+	mock.ExpectQuery(`insert into "coffee"`).WithArgs("Arabica", "3.50").
+		WillReturnError(&pgconn.PgError{Code: "23505", Message: "duplicate key value violates unique constraint"})
+
+	got, err := insertCoffeePostgres(context.Background(), mock, Coffee{Bean: "Arabica", Price: parsePrice("3.50")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 7 {
+		t.Errorf("id = %v, expected 7", got.ID)
+	}
+	if _, err := insertCoffeePostgres(context.Background(), mock, Coffee{Bean: "Arabica", Price: parsePrice("3.50")}); !errors.Is(err, ErrCoffeeConflict) {
+		t.Errorf("insertCoffeePostgres error = %v, expected %v", err, ErrCoffeeConflict)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_InsertCoffeeSQLServer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	query := regexp.QuoteMeta("insert into [coffee] ([bean], [price]) output inserted.[id] values (@p1, @p2)")
+	mock.ExpectQuery(query).WithArgs("Arabica", "3.50").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectQuery(query).WithArgs("Arabica", "3.50").
+		WillReturnError(mssqldb.Error{Number: 2627, Message: "Violation of UNIQUE KEY constraint"})
+
+	got, err := insertCoffeeSQLServer(context.Background(), db, Coffee{Bean: "Arabica", Price: parsePrice("3.50")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 7 {
+		t.Errorf("id = %v, expected 7", got.ID)
+	}
+	if _, err := insertCoffeeSQLServer(context.Background(), db, Coffee{Bean: "Arabica", Price: parsePrice("3.50")}); !errors.Is(err, ErrCoffeeConflict) {
+		t.Errorf("insertCoffeeSQLServer error = %v, expected %v", err, ErrCoffeeConflict)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_NewCoffeeHandlerInjection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coffee.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("create table coffee (id integer primary key, bean text, price text)"); err != nil {
+		t.Fatal(err)
+	}
+	useDBType(t, "SQLITE")
+	t.Setenv("DB_PATH", path)
+	t.Cleanup(closePools)
+
+	// Would close the insert and drop the table if the bean were spliced into the SQL
+	bean := "x', '1'); drop table coffee; --"
+	body, _ := json.Marshal(newCoffeeRequest{Bean: bean, Price: "1.00"})
+	rec := httptest.NewRecorder()
+	newCoffeeHandler(rec, httptest.NewRequest(http.MethodPost, "/coffee", strings.NewReader(string(body))))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %v, expected %v (body %s)", rec.Code, http.StatusCreated, rec.Body)
+	}
+
+	var got string
+	if err := db.QueryRow("select bean from coffee").Scan(&got); err != nil {
+		t.Fatalf("coffee table unreadable after insert: %v", err)
+	}
+	if got != bean {
+		t.Errorf("bean = %q, expected it stored verbatim as %q", got, bean)
+	}
+}
@@ -0,0 +1,119 @@
+// Reads the database and Bond settings from a JSON or YAML file, see CONFIG_FILE
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v2"
+)
+
+// The settings a config file may hold. Each is the same as the env var in its comment.
+type fileConfig struct {
+	DB struct {
+		Type        string `json:"type" yaml:"type"`                 // DB_TYPE
+		User        string `json:"user" yaml:"user"`                 // DB_USER
+		Pass        string `json:"pass" yaml:"pass"`                 // DB_PASS
+		Name        string `json:"name" yaml:"name"`                 // DB_NAME
+		Region      string `json:"region" yaml:"region"`             // DB_REGION
+		Cluster     string `json:"cluster" yaml:"cluster"`           // DB_CLUSTER
+		Instance    string `json:"instance" yaml:"instance"`         // DB_INSTANCE
+		Project     string `json:"project" yaml:"project"`           // DB_PROJECT
+		DSNTemplate string `json:"dsn_template" yaml:"dsn_template"` // DB_DSN_TEMPLATE
+		SSLMode     string `json:"sslmode" yaml:"sslmode"`           // DB_SSLMODE
+		IAMAuth     bool   `json:"iam_auth" yaml:"iam_auth"`         // DB_IAM_AUTH
+		Path        string `json:"path" yaml:"path"`                 // DB_PATH
+	} `json:"db" yaml:"db"`
+	Bond struct {
+		URL string `json:"url" yaml:"url"` // BOND_SERVICE_URL
+	} `json:"bond" yaml:"bond"`
+}
+
+// Parses a config file, as YAML for .yaml and .yml files and as JSON otherwise. Unknown keys are
+// rejected so a typo doesn't silently leave a setting out.
+func parseConfigFile(path string) (c fileConfig, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &c)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("config file %v: %w", path, err)
+	}
+	return c, nil
+}
+
+// A setting from a config file and the env var it stands for
+type fileSetting struct {
+	dbField
+	Value string
+}
+
+// The settings in a config file, including those it leaves empty
+func (c fileConfig) settings() []fileSetting {
+	iamAuth := ""
+	if c.DB.IAMAuth {
+		iamAuth = "true"
+	}
+	return []fileSetting{
+		{dbField{Env: "DB_TYPE", Key: "db.type"}, c.DB.Type},
+		{dbField{Env: "DB_USER", Key: "db.user"}, c.DB.User},
+		{dbField{Env: "DB_PASS", Key: "db.pass"}, c.DB.Pass},
+		{dbField{Env: "DB_NAME", Key: "db.name"}, c.DB.Name},
+		{dbField{Env: "DB_REGION", Key: "db.region"}, c.DB.Region},
+		{dbField{Env: "DB_CLUSTER", Key: "db.cluster"}, c.DB.Cluster},
+		{dbField{Env: "DB_INSTANCE", Key: "db.instance"}, c.DB.Instance},
+		{dbField{Env: "DB_PROJECT", Key: "db.project"}, c.DB.Project},
+		{dbField{Env: "DB_DSN_TEMPLATE", Key: "db.dsn_template"}, c.DB.DSNTemplate},
+		{dbField{Env: "DB_SSLMODE", Key: "db.sslmode"}, c.DB.SSLMode},
+		{dbField{Env: "DB_IAM_AUTH", Key: "db.iam_auth"}, iamAuth},
+		{dbField{Env: "DB_PATH", Key: "db.path"}, c.DB.Path},
+		{dbField{Env: "BOND_SERVICE_URL", Key: "bond.url"}, c.Bond.URL},
+	}
+}
+
+// Loads the config file at path into the environment, which the rest of the app reads its
+// settings from. Env vars that are already set (and not empty) win over the file. The database settings are
+// then checked as dbConnectionInfo does, naming the missing file key.
+func loadConfigFile(path string) error {
+	c, err := parseConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for _, f := range c.settings() {
+		if f.Value == "" {
+			continue
+		}
+		if os.Getenv(f.Env) != "" {
+			slog.Info("Config file setting overridden by env var", "key", f.Key, "env", f.Env)
+			continue
+		}
+		os.Setenv(f.Env, f.Value)
+	}
+	slog.Info("Loaded config file", "path", path)
+
+	// SQLite only needs a path, which DDDSQLiteOpen checks, and FAKE needs nothing
+	if dbType := os.Getenv("DB_TYPE"); dbType == "SQLITE" || dbType == "FAKE" {
+		return nil
+	}
+	if missing := missingDBFields(); len(missing) > 0 {
+		var names []string
+		for _, f := range missing {
+			names = append(names, fmt.Sprintf("%v (or %v)", f.Key, f.Env))
+		}
+		return fmt.Errorf("%w in config file %v: set %v", ErrMissingDBConfig, path, strings.Join(names, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_LoadConfigFile(t *testing.T) {
+	const yamlConfig = `
+db:
+  type: CLOUD_SQL_POSTGRES
+  user: decaf
+  pass: secret
+  name: coffee
+  region: europe-west1
+  instance: decaf-db
+bond:
+  url: https://bond.example.com
+`
+	const jsonConfig = `{
+	"db": {"type": "CLOUD_SQL_MYSQL", "user": "decaf", "name": "coffee", "region": "us-central1", "instance": "decaf-db", "iam_auth": true},
+	"bond": {"url": "https://bond.example.com"}
+}`
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     map[string]string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "yaml",
+			file:    "config.yaml",
+			content: yamlConfig,
+			want:    map[string]string{"DB_TYPE": "CLOUD_SQL_POSTGRES", "DB_PASS": "secret", "DB_REGION": "europe-west1", "BOND_SERVICE_URL": "https://bond.example.com"},
+		},
+		{
+			name:    "json",
+			file:    "config.json",
+			content: jsonConfig,
+			want:    map[string]string{"DB_TYPE": "CLOUD_SQL_MYSQL", "DB_IAM_AUTH": "true", "DB_INSTANCE": "decaf-db", "DB_PASS": ""},
+		},
+		{
+			name:    "env overrides file",
+			file:    "config.yaml",
+			content: yamlConfig,
+			env:     map[string]string{"DB_NAME": "staging", "BOND_SERVICE_URL": "http://localhost:8081"},
+			want:    map[string]string{"DB_NAME": "staging", "DB_USER": "decaf", "BOND_SERVICE_URL": "http://localhost:8081"},
+		},
+		{
+			name:    "missing fields",
+			file:    "config.yaml",
+			content: "db:\n  type: ALLOY_DB\n  user: decaf\n  pass: secret\n",
+			wantErr: "db.name (or DB_NAME), db.region (or DB_REGION), db.instance (or DB_INSTANCE)",
+		},
+		{
+			name:    "missing field set in env",
+			file:    "config.yaml",
+			content: "db:\n  type: ALLOY_DB\n  user: decaf\n  name: coffee\n  region: us-central1\n",
+			env:     map[string]string{"DB_PASS": "secret", "DB_INSTANCE": "decaf-db"},
+			want:    map[string]string{"DB_PASS": "secret", "DB_NAME": "coffee"},
+		},
+		{
+			name:    "sqlite",
+			file:    "config.json",
+			content: `{"db": {"type": "SQLITE", "path": "coffee.db"}}`,
+			want:    map[string]string{"DB_PATH": "coffee.db"},
+		},
+		{
+			name:    "unknown key",
+			file:    "config.yaml",
+			content: yamlConfig + "  pasword: typo\n",
+			wantErr: "pasword",
+		},
+		{
+			name:    "unknown json key",
+			file:    "config.json",
+			content: `{"db": {"type": "SQLITE", "paht": "coffee.db"}}`,
+			wantErr: "paht",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Cleared and restored afterwards, including the values the file sets
+			for _, f := range (fileConfig{}).settings() {
+				t.Setenv(f.Env, "")
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			err := loadConfigFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfigFile error = %v, expected it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.want {
+				if got := os.Getenv(k); got != v {
+					t.Errorf("%v = %q, expected %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func Test_LoadConfigFileMissingDBConfig(t *testing.T) {
+	for _, f := range (fileConfig{}).settings() {
+		t.Setenv(f.Env, "")
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"db": {"type": "CLOUD_SQL_POSTGRES"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(path); !errors.Is(err, ErrMissingDBConfig) {
+		t.Errorf("loadConfigFile error = %v, expected %v", err, ErrMissingDBConfig)
+	}
+}
@@ -0,0 +1,122 @@
+// CORS for browser-based clients, off unless CORS_ALLOWED_ORIGINS is set
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultCORSMethods = "GET, POST"
+	defaultCORSHeaders = "Content-Type"
+	// How long browsers may cache a preflight response
+	corsMaxAge = 10 * 60
+)
+
+// Which cross-origin requests browsers are allowed to make
+type corsPolicy struct {
+	Origins map[string]bool
+	// Any origin may call the app, only with CORS_INSECURE_ALLOW_ALL
+	AnyOrigin bool
+	Methods   []string
+	Headers   []string
+}
+
+// Splits a comma separated env var, returning def when it is unset
+func envList(key string, def string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		v = def
+	}
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Reads the policy from CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS and CORS_ALLOWED_HEADERS.
+// No origins are allowed by default. "*" is refused unless CORS_INSECURE_ALLOW_ALL is true, as
+// it lets any website call the app from its visitors' browsers.
+func corsPolicyFromEnv() (p corsPolicy, err error) {
+	p.Origins = map[string]bool{}
+	for _, origin := range envList("CORS_ALLOWED_ORIGINS", "") {
+		if origin == "*" {
+			if os.Getenv("CORS_INSECURE_ALLOW_ALL") != "true" {
+				return p, fmt.Errorf("CORS_ALLOWED_ORIGINS is * but CORS_INSECURE_ALLOW_ALL is not true")
+			}
+			p.AnyOrigin = true
+			continue
+		}
+		if !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return p, fmt.Errorf("invalid origin %v in CORS_ALLOWED_ORIGINS (expecting e.g. https://example.com)", origin)
+		}
+		p.Origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	for _, m := range envList("CORS_ALLOWED_METHODS", defaultCORSMethods) {
+		p.Methods = append(p.Methods, strings.ToUpper(m))
+	}
+	p.Headers = envList("CORS_ALLOWED_HEADERS", defaultCORSHeaders)
+	return p, nil
+}
+
+func (p corsPolicy) allowOrigin(origin string) bool {
+	return p.AnyOrigin || p.Origins[origin]
+}
+
+func (p corsPolicy) allowMethod(method string) bool {
+	for _, m := range p.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds CORS headers for allowed origins and answers their preflight requests. Requests without
+// an Origin header, e.g. from other services, are passed on untouched.
+func (p corsPolicy) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !p.allowOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			// The browser blocks the response without an Access-Control-Allow-Origin header
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowOrigin := origin
+		if p.AnyOrigin {
+			allowOrigin = "*"
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		if !preflight {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		if !p.allowMethod(r.Header.Get("Access-Control-Request-Method")) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.Methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.Headers, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
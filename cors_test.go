@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_CORS(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com, https://admin.example.com/")
+	p, err := corsPolicyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := p.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	tests := []struct {
+		name          string
+		method        string
+		origin        string
+		requestMethod string
+		wantStatus    int
+		wantOrigin    string
+		wantMethods   string
+	}{
+		{name: "no origin", method: http.MethodGet, wantStatus: http.StatusOK},
+		{name: "allowed", method: http.MethodGet, origin: "https://app.example.com", wantStatus: http.StatusOK, wantOrigin: "https://app.example.com"},
+		{name: "allowed with trailing slash", method: http.MethodGet, origin: "https://admin.example.com", wantStatus: http.StatusOK, wantOrigin: "https://admin.example.com"},
+		{name: "disallowed", method: http.MethodGet, origin: "https://evil.example.com", wantStatus: http.StatusOK},
+		{name: "preflight", method: http.MethodOptions, origin: "https://app.example.com", requestMethod: "POST", wantStatus: http.StatusNoContent, wantOrigin: "https://app.example.com", wantMethods: "GET, POST"},
+		{name: "preflight disallowed origin", method: http.MethodOptions, origin: "https://evil.example.com", requestMethod: "GET", wantStatus: http.StatusForbidden},
+		{name: "preflight disallowed method", method: http.MethodOptions, origin: "https://app.example.com", requestMethod: "DELETE", wantStatus: http.StatusForbidden, wantOrigin: "https://app.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, expected %v", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, expected %q", got, tt.wantOrigin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, expected %q", got, tt.wantMethods)
+			}
+		})
+	}
+}
+
+func Test_CORSPolicyFromEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     string
+		insecure    string
+		wantAny     bool
+		wantErr     bool
+		wantOrigins int
+	}{
+		{name: "default", wantOrigins: 0},
+		{name: "list", origins: "https://a.example.com,http://localhost:3000", wantOrigins: 2},
+		{name: "wildcard refused", origins: "*", wantErr: true},
+		{name: "wildcard insecure", origins: "*", insecure: "true", wantAny: true},
+		{name: "not an origin", origins: "example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CORS_ALLOWED_ORIGINS", tt.origins)
+			t.Setenv("CORS_INSECURE_ALLOW_ALL", tt.insecure)
+			p, err := corsPolicyFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("corsPolicyFromEnv error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if p.AnyOrigin != tt.wantAny || len(p.Origins) != tt.wantOrigins {
+				t.Errorf("corsPolicyFromEnv = %+v, expected any origin %v and %v origins", p, tt.wantAny, tt.wantOrigins)
+			}
+		})
+	}
+
+	t.Setenv("CORS_ALLOWED_ORIGINS", "*")
+	t.Setenv("CORS_INSECURE_ALLOW_ALL", "true")
+	p, _ := corsPolicyFromEnv()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	p.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rec, req)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, expected *", got)
+	}
+}
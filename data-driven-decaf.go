@@ -3,38 +3,244 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/alloydbconn"
 	"cloud.google.com/go/alloydbconn/driver/pgxv4"
+	alloyerr "cloud.google.com/go/alloydbconn/errtype"
 	"cloud.google.com/go/cloudsqlconn"
+	cloudsqlerr "cloud.google.com/go/cloudsqlconn/errtype"
 	"cloud.google.com/go/cloudsqlconn/mysql/mysql"
+	"cloud.google.com/go/cloudsqlconn/sqlserver/mssql"
 	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	mssqldb "github.com/microsoft/go-mssqldb"
+	"go.uber.org/automaxprocs/maxprocs"
+	"golang.org/x/exp/slog"
+	"golang.org/x/sync/singleflight"
+	_ "modernc.org/sqlite"
 )
 
 type DDDBondPayload struct {
 	MagicCoffee string `json:"magic_coffee,omitempty"`
-	Total       int    `json:"total,omitempty"`
-	Project     string `json:"project,omitempty"`
-	DB          string `json:"db,omitempty"`
+	// Sum of the prices in whole units (cents dropped), kept as an integer for Bond
+	Total int `json:"total,omitempty"`
+	// Exact sum of the prices in cents
+	TotalCents int64  `json:"total_cents,omitempty"`
+	Project    string `json:"project,omitempty"`
+	DB         string `json:"db,omitempty"`
+	// Rows left out of the total because their price was not a number
+	SkippedRows int `json:"skipped_rows,omitempty"`
+	// Rows scanned, and how long the query and scan took
+	RowCount        int   `json:"row_count"`
+	QueryDurationMs int64 `json:"query_duration_ms"`
+	// Set when no rows were read, in which case Bond isn't asked to verify the zeros
+	Empty bool `json:"empty,omitempty"`
+	// Set when ?limit= or ?offset= read only part of the table, in which case Bond isn't asked to
+	// verify the page's totals
+	Partial bool `json:"partial,omitempty"`
+	// Every row read, only collected for requests with ?detail=true and never sent to Bond.
+	// Streamed rather than collected for NDJSON requests.
+	Coffees []Coffee `json:"coffees,omitempty"`
+	// The request's query parameters named in BOND_FORWARD_PARAMS, e.g. a player ID. Only set on
+	// what is sent to Bond.
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// A copy of p that shares no slices or maps with it
+func (p DDDBondPayload) clone() DDDBondPayload {
+	if p.Coffees != nil {
+		p.Coffees = append([]Coffee(nil), p.Coffees...)
+	}
+	if p.Params != nil {
+		params := make(map[string]string, len(p.Params))
+		for k, v := range p.Params {
+			params[k] = v
+		}
+		p.Params = params
+	}
+	return p
+}
+
+// A row of the coffee table. Price is as stored, so prices that aren't numbers are kept too.
+type Coffee struct {
+	ID    int64  `json:"id"`
+	Bean  string `json:"bean"`
+	Price Price  `json:"price"`
+}
+
+type coffeeDetailKey struct{}
+
+// Asks the row loops to collect every row in DDDBondPayload.Coffees
+func withCoffeeDetail(ctx context.Context) context.Context {
+	return context.WithValue(ctx, coffeeDetailKey{}, true)
+}
+
+func wantCoffeeDetail(ctx context.Context) bool {
+	detail, _ := ctx.Value(coffeeDetailKey{}).(bool)
+	return detail
+}
+
+// A page of the coffee rows, from ?limit= and ?offset=
+type coffeePage struct {
+	Limit  int
+	Offset int
+}
+
+type coffeePageKey struct{}
+
+// Asks the row queries to read only one page of the coffee rows
+func withCoffeePage(ctx context.Context, p coffeePage) context.Context {
+	return context.WithValue(ctx, coffeePageKey{}, p)
+}
+
+func coffeePageFrom(ctx context.Context) (coffeePage, bool) {
+	p, ok := ctx.Value(coffeePageKey{}).(coffeePage)
+	return p, ok
 }
 
 type DBConnectionInfo struct {
-	User       string
-	Pass       string
-	DBName     string
-	DBRegion   string
-	DBCluster  string
-	DBInstance string
-	ProjectID  string
+	User       string `json:"user"`
+	Pass       string `json:"pass"`
+	DBName     string `json:"db_name"`
+	DBRegion   string `json:"region"`
+	DBCluster  string `json:"cluster,omitempty"`
+	DBInstance string `json:"instance"`
+	ProjectID  string `json:"project_id"`
+	// Dial target from DB_CONN_NAME, used instead of the one built from the fields above
+	ConnName string `json:"conn_name,omitempty"`
+	// Optional DSN with {placeholders}, used instead of the DSN we assemble
+	DSNTemplate string `json:"dsn_template,omitempty"`
+	// Postgres sslmode, substituted for {sslmode} in DSNTemplate
+	SSLMode string `json:"sslmode"`
+	// Postgres sslrootcert, substituted for {sslrootcert} in DSNTemplate
+	SSLRootCert string `json:"sslrootcert,omitempty"`
+	// Log in with the service account's IAM identity rather than a password
+	IAMAuth bool `json:"iam_auth"`
+}
+
+// Whether DB_IAM_AUTH asks for IAM database authentication instead of a password
+func dbIAMAuth() bool {
+	return os.Getenv("DB_IAM_AUTH") == "true"
+}
+
+// Whether DB_LAZY_REFRESH asks for connector certificates to be fetched as connections are made
+// instead of refreshed ahead in the background (see lazyAlloyDial)
+func dbLazyRefresh() bool {
+	return os.Getenv("DB_LAZY_REFRESH") == "true"
+}
+
+// The MySQL and SQL Server drivers own their dialers, so certificates can only be fetched lazily
+// for AlloyDB and Cloud SQL Postgres
+var errLazyRefreshDriver = errors.New("DB_LAZY_REFRESH is only supported with ALLOY_DB and CLOUD_SQL_POSTGRES")
+
+// A database setting, by env var and by key in a config file
+type dbField struct {
+	Env string
+	Key string
+}
+
+// Settings every cloud database needs
+var requiredDBFields = []dbField{
+	{Env: "DB_USER", Key: "db.user"},
+	{Env: "DB_NAME", Key: "db.name"},
+	{Env: "DB_REGION", Key: "db.region"},
+	{Env: "DB_INSTANCE", Key: "db.instance"},
+}
+
+// Cloud regions are lowercase words joined by hyphens, ending in a number, e.g. us-central1 or
+// northamerica-northeast1
+var dbRegionPattern = regexp.MustCompile(`^[a-z]+(-[a-z]+)+[0-9]+$`)
+
+// Checks region, read from env, looks like a cloud region, so a typo is reported as such rather
+// than as an opaque error from the connector
+func checkDBRegion(env, region string) error {
+	if !dbRegionPattern.MatchString(region) {
+		return fmt.Errorf("%w: %v %q is not a region (expecting e.g. us-central1)", ErrInvalidDBConfig, env, region)
+	}
+	return nil
+}
+
+// DB_CONN_NAME, the connectors' dial target (e.g. an emulator's), used as it is instead of being
+// built from the project, region, cluster and instance. Setting it blank is a mistake rather than
+// a way to unset it.
+func dbConnName() (string, error) {
+	name, ok := os.LookupEnv("DB_CONN_NAME")
+	if ok && strings.TrimSpace(name) == "" {
+		return "", fmt.Errorf("%w: DB_CONN_NAME is set but empty (unset it to connect to DB_INSTANCE in DB_REGION)", ErrInvalidDBConfig)
+	}
+	return name, nil
+}
+
+// Checks the settings that say where the database lives, which go into the instance connection
+// name, so a missing or malformed one stops the app at startup. Every cloud database needs
+// DB_REGION and DB_INSTANCE, and AlloyDB's resource path needs DB_CLUSTER too, unless
+// DB_CONN_NAME names the instance itself.
+func checkDBLocation(engine string) error {
+	if engine == "SQLITE" || engine == "FAKE" {
+		return nil
+	}
+	connName, err := dbConnName()
+	if err != nil {
+		return err
+	}
+	required := []string{"DB_REGION", "DB_INSTANCE"}
+	if engine == "ALLOY_DB" {
+		required = append(required, "DB_CLUSTER")
+	}
+	if connName != "" {
+		required = nil
+	}
+	for _, k := range required {
+		if os.Getenv(k) == "" {
+			return fmt.Errorf("%w: %v not set (required for %v)", ErrMissingDBConfig, k, engine)
+		}
+	}
+	if region := os.Getenv("DB_REGION"); region != "" {
+		if err := checkDBRegion("DB_REGION", region); err != nil {
+			return err
+		}
+	}
+	if region := os.Getenv("DB_READ_REGION"); region != "" {
+		return checkDBRegion("DB_READ_REGION", region)
+	}
+	return nil
+}
+
+// The required database settings that aren't set. DB_PASS is required too, unless DB_IAM_AUTH
+// logs in with a token instead, and DB_CONN_NAME stands in for DB_REGION and DB_INSTANCE.
+func missingDBFields() (missing []dbField) {
+	connName := os.Getenv("DB_CONN_NAME") != ""
+	for _, f := range requiredDBFields {
+		if connName && (f.Env == "DB_REGION" || f.Env == "DB_INSTANCE") {
+			continue
+		}
+		if os.Getenv(f.Env) == "" {
+			missing = append(missing, f)
+		}
+	}
+	if os.Getenv("DB_PASS") == "" && !dbIAMAuth() {
+		missing = append(missing, dbField{Env: "DB_PASS", Key: "db.pass"})
+	}
+	return missing
 }
 
 func dbConnectionInfo() (info DBConnectionInfo, err error) {
@@ -45,8 +251,22 @@ func dbConnectionInfo() (info DBConnectionInfo, err error) {
 	dbCluster := os.Getenv("DB_CLUSTER")
 	dbInstance := os.Getenv("DB_INSTANCE")
 	dbProject := os.Getenv("DB_PROJECT")
-	if user == "" || pass == "" || dbInstance == "" || dbName == "" {
-		return info, fmt.Errorf("ensure required environment variables are set")
+	iamAuth := dbIAMAuth()
+	if missing := missingDBFields(); len(missing) > 0 {
+		var names []string
+		for _, f := range missing {
+			names = append(names, f.Env)
+		}
+		return info, fmt.Errorf("%w: ensure %v are set (DB_PASS isn't needed with DB_IAM_AUTH=true)", ErrMissingDBConfig, strings.Join(names, ", "))
+	}
+	connName, err := dbConnName()
+	if err != nil {
+		return info, err
+	}
+	if dbRegion != "" {
+		if err := checkDBRegion("DB_REGION", dbRegion); err != nil {
+			return info, err
+		}
 	}
 	if dbProject == "" {
 		dbProject = cfg.ProjectID
@@ -58,257 +278,1728 @@ func dbConnectionInfo() (info DBConnectionInfo, err error) {
 	info.DBCluster = dbCluster
 	info.DBInstance = dbInstance
 	info.ProjectID = dbProject
+	info.ConnName = connName
+	info.DSNTemplate = os.Getenv("DB_DSN_TEMPLATE")
+	info.IAMAuth = iamAuth
+	info.SSLMode = os.Getenv("DB_SSLMODE")
+	if info.SSLMode == "" {
+		info.SSLMode = defaultSSLMode
+	}
+	info.SSLRootCert = os.Getenv("DB_SSLROOTCERT")
 	return info, nil
 }
 
-const defaultQuery = "select * from coffee"
+type readReplicaKey struct{}
+
+// Asks the shared pools for the read replica rather than the primary, if one is configured
+func withReadReplica(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readReplicaKey{}, true)
+}
+
+// Whether ctx asks for the read replica and DB_READ_INSTANCE configures one
+func wantReadReplica(ctx context.Context) bool {
+	read, _ := ctx.Value(readReplicaKey{}).(bool)
+	return read && os.Getenv("DB_READ_INSTANCE") != ""
+}
+
+// The connection info for the primary, or for the read replica when ctx asks for it. The replica
+// is DB_READ_INSTANCE in DB_READ_REGION, falling back to DB_REGION, and shares every other
+// setting (user, password, database, cluster, project) with the primary. DB_CONN_NAME only names
+// the primary, so the replica's name is always built.
+func connectionInfo(ctx context.Context) (DBConnectionInfo, error) {
+	info, err := dbConnectionInfo()
+	if err != nil || !wantReadReplica(ctx) {
+		return info, err
+	}
+	info.DBInstance = os.Getenv("DB_READ_INSTANCE")
+	info.ConnName = ""
+	if region := os.Getenv("DB_READ_REGION"); region != "" {
+		if err := checkDBRegion("DB_READ_REGION", region); err != nil {
+			return info, err
+		}
+		info.DBRegion = region
+	}
+	if info.DBRegion == "" {
+		return info, fmt.Errorf("%w: DB_READ_REGION or DB_REGION not set (required for DB_READ_INSTANCE)", ErrMissingDBConfig)
+	}
+	return info, nil
+}
+
+// The connectors already encrypt the connection, so Postgres' own TLS is off unless DB_SSLMODE says otherwise
+const defaultSSLMode = "disable"
+
+// Values Postgres accepts for sslmode
+var sslModes = map[string]bool{"disable": true, "allow": true, "prefer": true, "require": true, "verify-ca": true, "verify-full": true}
+
+// The sslmode and sslrootcert DSN parameters from DB_SSLMODE and DB_SSLROOTCERT. The root CA is
+// only used by verify-ca and verify-full, which check the server's certificate against it
+// (falling back to the system roots when DB_SSLROOTCERT is unset). Through a connector the
+// certificate is for the connector's tunnel rather than the database, so those modes can't be
+// used, and a DSN template has to have {sslrootcert} for the root CA to be used at all.
+func postgresSSLParams(template string, connector bool) (string, error) {
+	mode := os.Getenv("DB_SSLMODE")
+	if mode == "" {
+		mode = defaultSSLMode
+	}
+	if !sslModes[mode] {
+		return "", fmt.Errorf("invalid DB_SSLMODE %v (expecting disable, allow, prefer, require, verify-ca or verify-full)", mode)
+	}
+	verify := mode == "verify-ca" || mode == "verify-full"
+	if verify && connector {
+		return "", fmt.Errorf("%w: DB_SSLMODE %v can't verify the database through the connector (expecting disable, allow, prefer or require)", ErrInvalidDBConfig, mode)
+	}
+	params := "sslmode=" + mode
+	rootCert := os.Getenv("DB_SSLROOTCERT")
+	if rootCert == "" {
+		return params, nil
+	}
+	if !verify {
+		return "", fmt.Errorf("DB_SSLROOTCERT is only used with DB_SSLMODE verify-ca or verify-full, not %v", mode)
+	}
+	if template != "" && !strings.Contains(template, "{sslrootcert}") {
+		return "", fmt.Errorf("%w: DB_SSLROOTCERT is set but DB_DSN_TEMPLATE has no {sslrootcert}", ErrInvalidDBConfig)
+	}
+	if _, err := os.Stat(rootCert); err != nil {
+		return "", fmt.Errorf("cannot read DB_SSLROOTCERT: %w", err)
+	}
+	// Quote the path, as it may contain spaces
+	return fmt.Sprintf("%s sslrootcert='%s'", params, dsnValueEscape(rootCert)), nil
+}
+
+// Categories of database errors, used to label metrics
+const (
+	dbOutcomeSuccess = "success"
+	dbOutcomeAuth    = "auth_error"
+	dbOutcomeNetwork = "network_error"
+	dbOutcomeTimeout = "timeout"
+	dbOutcomeOther   = "other_error"
+)
+
+// Categorises a database error so auth problems (e.g. a rotated password) can be told apart from
+// network problems. Connector certificate refresh failures count as auth errors, as they are
+// almost always missing permissions or bad credentials.
+func dbErrorCategory(err error) string {
+	var (
+		netErr          net.Error
+		pgErr           *pgconn.PgError
+		mysqlErr        *mysqldriver.MySQLError
+		mssqlErr        mssqldb.Error
+		sqlRefreshErr   *cloudsqlerr.RefreshError
+		alloyRefreshErr *alloyerr.RefreshError
+		sqlDialErr      *cloudsqlerr.DialError
+		alloyDialErr    *alloyerr.DialError
+	)
+	switch {
+	case err == nil:
+		return dbOutcomeSuccess
+	case errors.Is(err, context.DeadlineExceeded), pgconn.Timeout(err), errors.As(err, &netErr) && netErr.Timeout():
+		return dbOutcomeTimeout
+	// Postgres class 28 is invalid authorization, MySQL 1044/1045/1698 are access denied and SQL
+	// Server 18456 is a failed login
+	case errors.As(err, &pgErr) && strings.HasPrefix(pgErr.Code, "28"),
+		errors.As(err, &mysqlErr) && (mysqlErr.Number == 1044 || mysqlErr.Number == 1045 || mysqlErr.Number == 1698),
+		errors.As(err, &mssqlErr) && mssqlErr.Number == 18456,
+		errors.As(err, &sqlRefreshErr), errors.As(err, &alloyRefreshErr):
+		return dbOutcomeAuth
+	case errors.As(err, &netErr), errors.As(err, &sqlDialErr), errors.As(err, &alloyDialErr):
+		return dbOutcomeNetwork
+	default:
+		return dbOutcomeOther
+	}
+}
+
+// Checks a MySQL or SQL Server DSN template has none of the Postgres SSL placeholders, which
+// those drivers don't understand
+func checkDSNTemplateSSL(template string) error {
+	for _, p := range []string{"{sslmode}", "{sslrootcert}"} {
+		if strings.Contains(template, p) {
+			return fmt.Errorf("%w: DB_DSN_TEMPLATE has %v, which only Postgres DSNs take", ErrInvalidDBConfig, p)
+		}
+	}
+	return nil
+}
+
+// Placeholders that must appear in DB_DSN_TEMPLATE ({pass} is not needed with IAM authentication)
+var requiredDSNPlaceholders = []string{"{user}", "{pass}", "{dbname}"}
+
+// A key=value DSN, as Postgres takes, rather than a URL or MySQL's user:pass@addr/dbname
+var dsnKeyValue = regexp.MustCompile(`^\s*\w+\s*=`)
+
+// Escapes a value for a URL DSN. Every reserved character is percent-encoded, so the value can go
+// in the user info, the path or the query.
+func dsnURLEscape(v string) string {
+	return strings.ReplaceAll(url.QueryEscape(v), "+", "%20")
+}
+
+// Escapes the backslashes and single quotes of a value for a quoted key=value DSN value
+func dsnValueEscape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v)
+}
+
+// Quotes a value for a key=value DSN when it is empty or has whitespace, quotes or backslashes,
+// so it can't end early or add parameters of its own
+func dsnValueQuote(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\r\n\f\v'\\") {
+		return v
+	}
+	return "'" + dsnValueEscape(v) + "'"
+}
+
+// Returns the DSN built from DB_DSN_TEMPLATE if one is set, otherwise the default DSN.
+// Placeholders are substituted in a single pass, so values containing placeholders are not expanded
+// again. Values are escaped for the template's syntax: percent-encoded in a URL, and quoted where
+// needed in key=value pairs.
+func buildDSN(info DBConnectionInfo, def string) (string, error) {
+	if info.DSNTemplate == "" {
+		return def, nil
+	}
+	var missing []string
+	for _, p := range requiredDSNPlaceholders {
+		if p == "{pass}" && info.IAMAuth {
+			continue
+		}
+		if !strings.Contains(info.DSNTemplate, p) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("DB_DSN_TEMPLATE is missing placeholders %v", strings.Join(missing, ", "))
+	}
+	values := [][2]string{
+		{"{user}", info.User},
+		{"{pass}", info.Pass},
+		{"{dbname}", info.DBName},
+		{"{project}", info.ProjectID},
+		{"{region}", info.DBRegion},
+		{"{cluster}", info.DBCluster},
+		{"{instance}", info.DBInstance},
+		{"{sslmode}", info.SSLMode},
+		{"{sslrootcert}", info.SSLRootCert},
+	}
+	var oldnew []string
+	switch {
+	case strings.Contains(info.DSNTemplate, "://"):
+		for _, v := range values {
+			oldnew = append(oldnew, v[0], dsnURLEscape(v[1]))
+		}
+	case dsnKeyValue.MatchString(info.DSNTemplate):
+		// A placeholder the template already quotes only needs escaping
+		for _, v := range values {
+			oldnew = append(oldnew, "'"+v[0]+"'", "'"+dsnValueEscape(v[1])+"'")
+		}
+		for _, v := range values {
+			oldnew = append(oldnew, v[0], dsnValueQuote(v[1]))
+		}
+	default:
+		// MySQL's DSN takes the password as is, up to the last @ before the database name
+		for _, v := range values {
+			oldnew = append(oldnew, v[0], v[1])
+		}
+	}
+	dsn := strings.NewReplacer(oldnew...).Replace(info.DSNTemplate)
+	// The DSN holds the password, so it is never logged
+	slog.Info("Using DSN from DB_DSN_TEMPLATE")
+	return dsn, nil
+}
+
+// Zero-based position of the row whose bean is the magic coffee, the same for every backend,
+// unless MAGIC_INDEX is set. With ?limit= or ?offset= it counts from the first row of the page,
+// so the magic coffee is only the table's when the page starts at offset 0 and reaches the index.
+const defaultMagicIndex = 50
+
+// The magic coffee's row position from MAGIC_INDEX, a non-negative integer
+func magicIndex() (int, error) {
+	v := os.Getenv("MAGIC_INDEX")
+	if v == "" {
+		return defaultMagicIndex, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid MAGIC_INDEX %v (expecting a non-negative integer)", v)
+	}
+	return n, nil
+}
+
+// Notes when there were too few rows to reach the magic coffee, which leaves it empty
+func logMagicOutOfRange(ctx context.Context, index, rows int) {
+	if rows <= index {
+		loggerFrom(ctx).Info("No magic coffee: fewer rows than MAGIC_INDEX", "magic_index", index, "rows", rows)
+	}
+}
+
+// Default for QUERY_MAX_LIMIT
+const defaultQueryMaxLimit = 1000
+
+// Columns the coffee query must return: id, bean and price
+const coffeeColumns = 3
+
+// The query that returns the coffee rows: QUERY if set, otherwise a select of the id, bean and
+// price columns (see coffeeSchema) quoted for the dialect, across every table of DB_TABLES
+func coffeeQuery(d sqlDialect) (string, error) {
+	q, ok := os.LookupEnv("QUERY")
+	if !ok || q == "" {
+		s, err := quotedCoffeeSchema(d)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("select %v, %v, %v from %v%v", s.ID, s.Bean, s.Price, s.source(), s.order()), nil
+	}
+	if coffeeSchemaSet() {
+		return "", fmt.Errorf("QUERY can't be combined with DB_TABLE, DB_TABLES or the DB_*_COLUMN settings")
+	}
+	if strings.TrimSpace(q) == "" {
+		return "", fmt.Errorf("QUERY is blank")
+	}
+	if err := singleStatement(q); err != nil {
+		return "", fmt.Errorf("invalid QUERY: %w", err)
+	}
+	return q, nil
+}
+
+// Checks q is a single SQL statement, allowing one trailing semicolon. Semicolons in quoted
+// strings and identifiers are fine. Comments and backslashes in quotes are rejected rather than
+// parsed, as databases treat them differently and they could hide a second statement.
+func singleStatement(q string) error {
+	q = strings.TrimSuffix(strings.TrimSpace(q), ";")
+	var quote byte
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case quote != 0 && c == '\\':
+			return fmt.Errorf("backslashes in quoted strings are not supported")
+		case quote != 0:
+			// A doubled quote closes and reopens the string, which works out the same
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '#', strings.HasPrefix(q[i:], "--"), strings.HasPrefix(q[i:], "/*"):
+			return fmt.Errorf("comments are not supported")
+		case c == ';':
+			return fmt.Errorf("expected a single statement")
+		}
+	}
+	if quote != 0 {
+		return fmt.Errorf("unterminated quote %c", quote)
+	}
+	return nil
+}
+
+// Largest ?limit= a request may ask for, from QUERY_MAX_LIMIT
+func queryMaxLimit() (int, error) {
+	v := os.Getenv("QUERY_MAX_LIMIT")
+	if v == "" {
+		return defaultQueryMaxLimit, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid QUERY_MAX_LIMIT %v (expecting a positive number)", v)
+	}
+	return n, nil
+}
 
-// Init AlloyDB and MySQL driver registration on startup
-func DDDInit() error {
-	alloyDBCleanup, err := pgxv4.RegisterDriver("alloydb")
+// Reads ?limit= and ?offset=, which must be non-negative integers. A limit above QUERY_MAX_LIMIT
+// is capped to it, and an offset on its own gets the maximum limit. ok is false when neither is set.
+func parseCoffeePage(q url.Values) (p coffeePage, ok bool, err error) {
+	limit, offset := q.Get("limit"), q.Get("offset")
+	if limit == "" && offset == "" {
+		return p, false, nil
+	}
+	max, err := queryMaxLimit()
 	if err != nil {
-		log.Printf("failed to parse pgx config: %v\n", err)
-		return err
+		return p, false, err
+	}
+	p.Limit = max
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return p, false, fmt.Errorf("%w: limit %q is not a non-negative integer", ErrInvalidPage, limit)
+		}
+		if n < max {
+			p.Limit = n
+		}
+	}
+	if offset != "" {
+		p.Offset, err = strconv.Atoi(offset)
+		if err != nil || p.Offset < 0 {
+			return p, false, fmt.Errorf("%w: offset %q is not a non-negative integer", ErrInvalidPage, offset)
+		}
 	}
-	defer alloyDBCleanup()
+	return p, true, nil
+}
+
+// Adds LIMIT and OFFSET to the coffee query when the request asked for a page. They are passed
+// as arguments, with placeholders numbered ($1, $2) for Postgres or not (?) for MySQL and SQLite.
+// SQL Server has OFFSET ... FETCH instead, which needs an ORDER BY, so a query without one is
+// given one that keeps the natural order.
+func pagedQuery(ctx context.Context, query string, d sqlDialect) (string, []interface{}) {
+	p, ok := coffeePageFrom(ctx)
+	if !ok {
+		return query, nil
+	}
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	switch d {
+	case dialectPostgres:
+		return query + " limit $1 offset $2", []interface{}{p.Limit, p.Offset}
+	case dialectSQLServer:
+		if !strings.Contains(strings.ToLower(query), "order by") {
+			query += " order by (select null)"
+		}
+		return query + " offset @p1 rows fetch next @p2 rows only", []interface{}{p.Offset, p.Limit}
+	default:
+		return query + " limit ? offset ?", []interface{}{p.Limit, p.Offset}
+	}
+}
 
-	mySQLCleanup, err := mysql.RegisterDriver("cloudsql-mysql")
+// Checks the query returned id, bean and price columns
+func checkCoffeeColumns(n int) error {
+	if n != coffeeColumns {
+		return fmt.Errorf("expected %v columns (id, bean, price) from the query, got %v", coffeeColumns, n)
+	}
+	return nil
+}
+
+// Bond endpoint that verifies Data-Driven Decaf results, unless BOND_VERIFY_PATH is set
+const defaultDDDVerifyPath = "/v1/data_driven_decaf/verify"
+
+// Bond endpoint that verifies several results in one request, unless BOND_VERIFY_BATCH_PATH is set
+const defaultDDDVerifyBatchPath = "/v1/data_driven_decaf/verify_batch"
+
+const defaultAutoPoolMultiplier = 2
+
+// Pool defaults, kept small so a few instances can't exhaust a small Cloud SQL instance's connections
+const (
+	defaultDBMaxConns        = 10
+	defaultDBMaxConnLifetime = 30 * time.Minute
+)
+
+// Connection limits applied to every pool
+type poolSettings struct {
+	MaxConns int
+	// Connections Postgres pools keep open even when idle
+	MinConns int
+	// Connections are closed and replaced once they are this old
+	MaxConnLifetime time.Duration
+}
+
+var dbPool = poolSettings{MaxConns: defaultDBMaxConns, MaxConnLifetime: defaultDBMaxConnLifetime}
+
+// Reads the pool settings from DB_MAX_CONNS, DB_MIN_CONNS and DB_MAX_CONN_LIFETIME, a duration
+// such as 30m or a number of seconds (DB_MAX_CONN_LIFETIME_S is still read as an alias).
+// DB_MAX_CONNS defaults to autoMax when set (see DB_AUTO_POOL), otherwise defaultDBMaxConns.
+func dbPoolSettings(autoMax int) (p poolSettings, err error) {
+	p.MaxConns = defaultDBMaxConns
+	if autoMax > 0 {
+		p.MaxConns = autoMax
+	}
+	if v := os.Getenv("DB_MAX_CONNS"); v != "" {
+		p.MaxConns, err = strconv.Atoi(v)
+		if err != nil || p.MaxConns <= 0 {
+			return p, fmt.Errorf("invalid DB_MAX_CONNS %v (expecting a positive number)", v)
+		}
+	}
+	if v := os.Getenv("DB_MIN_CONNS"); v != "" {
+		p.MinConns, err = strconv.Atoi(v)
+		if err != nil || p.MinConns < 0 {
+			return p, fmt.Errorf("invalid DB_MIN_CONNS %v (expecting a non-negative number)", v)
+		}
+	}
+	if p.MinConns > p.MaxConns {
+		return p, fmt.Errorf("DB_MIN_CONNS %v is more than the %v maximum connections", p.MinConns, p.MaxConns)
+	}
+	p.MaxConnLifetime, err = dbMaxConnLifetime()
+	return p, err
+}
+
+// DB_MAX_CONN_LIFETIME, or DB_MAX_CONN_LIFETIME_S, or the default when neither is set
+func dbMaxConnLifetime() (time.Duration, error) {
+	v, alias := os.Getenv("DB_MAX_CONN_LIFETIME"), os.Getenv("DB_MAX_CONN_LIFETIME_S")
+	switch {
+	case v != "" && alias != "":
+		return 0, fmt.Errorf("%w: DB_MAX_CONN_LIFETIME and DB_MAX_CONN_LIFETIME_S are both set", ErrInvalidDBConfig)
+	case alias != "":
+		lifetime, err := envSeconds("DB_MAX_CONN_LIFETIME_S", defaultDBMaxConnLifetime)
+		if err == nil && lifetime == 0 {
+			err = fmt.Errorf("invalid DB_MAX_CONN_LIFETIME_S 0 (expecting a positive number of seconds)")
+		}
+		return lifetime, err
+	case v == "":
+		return defaultDBMaxConnLifetime, nil
+	}
+	lifetime, err := time.ParseDuration(v)
+	if n, nErr := strconv.Atoi(v); nErr == nil {
+		lifetime, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil || lifetime <= 0 {
+		return 0, fmt.Errorf("invalid DB_MAX_CONN_LIFETIME %q (expecting a positive duration, e.g. 30m, or number of seconds)", v)
+	}
+	return lifetime, nil
+}
+
+// Sets the pool settings from the environment. With DB_AUTO_POOL=true, GOMAXPROCS is first set
+// from the container's CPU quota (e.g. Cloud Run's cgroup limit) rather than the host's CPU count,
+// and pools default to GOMAXPROCS * DB_AUTO_POOL_MULTIPLIER connections.
+func initPoolSize() {
+	var autoMax int
+	if os.Getenv("DB_AUTO_POOL") == "true" {
+		multiplier := defaultAutoPoolMultiplier
+		if v := os.Getenv("DB_AUTO_POOL_MULTIPLIER"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				log.Fatalf("Invalid DB_AUTO_POOL_MULTIPLIER %v\n", v)
+			}
+			multiplier = n
+		}
+		if _, err := maxprocs.Set(maxprocs.Logger(func(format string, args ...interface{}) { slog.Info(fmt.Sprintf(format, args...)) })); err != nil {
+			slog.Warn("Could not set GOMAXPROCS from the CPU quota", "error", err)
+		}
+		autoMax = runtime.GOMAXPROCS(0) * multiplier
+		slog.Info("Connection pools sized from GOMAXPROCS", "max_conns", autoMax, "gomaxprocs", runtime.GOMAXPROCS(0), "multiplier", multiplier)
+	}
+	p, err := dbPoolSettings(autoMax)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	dbPool = p
+	slog.Info("Connection pool settings", "max_conns", p.MaxConns, "min_conns", p.MinConns, "max_conn_lifetime_s", p.MaxConnLifetime.Seconds())
+}
+
+// Driver registration (swapped out in tests)
+var (
+	registerAlloyDBDriver   = pgxv4.RegisterDriver
+	registerMySQLDriver     = mysql.RegisterDriver
+	registerSQLServerDriver = mssql.RegisterDriver
+)
+
+// Registers the AlloyDB, MySQL and SQL Server connector drivers for the life of the process, and creates the
+// shared dialer for DB_TYPE if it is AlloyDB or Cloud SQL Postgres. The returned cleanup closes the
+// drivers' and the shared dialers, so call it on shutdown once the pools using them are closed.
+func DDDInit() (cleanup func(), err error) {
+	alloyDBCleanup, err := registerAlloyDBDriver("alloydb")
+	if err != nil {
+		slog.Error("failed to register the AlloyDB driver", "error", err)
+		return nil, err
+	}
+
+	opts, err := cloudSQLDialerOptions()
+	if err != nil {
+		slog.Error("Cannot load Cloud SQL dialer options", "error", err)
+		alloyDBCleanup()
+		return nil, err
+	}
+	mySQLCleanup, err := registerMySQLDriver("cloudsql-mysql", opts...)
+	if err != nil {
+		slog.Error("failed to register the Cloud SQL MySQL driver", "error", err)
+		alloyDBCleanup()
+		return nil, err
+	}
+	sqlServerCleanup, err := registerSQLServerDriver("cloudsql-sqlserver", opts...)
+	if err != nil {
+		slog.Error("failed to register the Cloud SQL SQL Server driver", "error", err)
+		mySQLCleanup()
+		alloyDBCleanup()
+		return nil, err
+	}
+	cleanup = func() {
+		closeDialers()
+		if err := sqlServerCleanup(); err != nil {
+			slog.Warn("Could not close the Cloud SQL SQL Server dialer", "error", err)
+		}
+		if err := mySQLCleanup(); err != nil {
+			slog.Warn("Could not close the Cloud SQL MySQL dialer", "error", err)
+		}
+		if err := alloyDBCleanup(); err != nil {
+			slog.Warn("Could not close the AlloyDB dialer", "error", err)
+		}
+	}
+
+	// Do the dialer's auth and discovery now rather than in the first request. Cloud SQL Postgres
+	// has no use for it when connecting through DB_SOCKET_DIR, and with DB_LAZY_REFRESH there is no
+	// shared dialer.
+	if dbLazyRefresh() {
+		slog.Info("DB_LAZY_REFRESH is set: fetching connector certificates as connections are made")
+		return cleanup, nil
+	}
+	switch os.Getenv("DB_TYPE") {
+	case "ALLOY_DB":
+		_, err = sharedAlloyDialer()
+	case "CLOUD_SQL_POSTGRES":
+		if !usesCloudSQLSocket("CLOUD_SQL_POSTGRES") {
+			_, err = sharedCloudSQLDialer()
+		}
+	}
 	if err != nil {
-		log.Printf("failed to parse pgx config: %v\n", err)
+		slog.Error("failed to initialize dialer", "error", err)
+		cleanup()
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+// The Cloud SQL Auth Proxy's Unix socket for info's instance, under DB_SOCKET_DIR, or empty to
+// connect through the Go connector. Cloud Run and GKE sidecars mount the socket as
+// /cloudsql/PROJECT:REGION:INSTANCE.
+func cloudSQLSocket(info DBConnectionInfo) string {
+	dir := os.Getenv("DB_SOCKET_DIR")
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, cloudSQLConnName(info))
+}
+
+// The Cloud SQL instance connection name the connectors dial, PROJECT:REGION:INSTANCE, unless
+// DB_CONN_NAME gives it
+func cloudSQLConnName(info DBConnectionInfo) string {
+	if info.ConnName != "" {
+		return info.ConnName
+	}
+	return fmt.Sprintf("%s:%s:%s", info.ProjectID, info.DBRegion, info.DBInstance)
+}
+
+// The AlloyDB instance URI the connector dials, unless DB_CONN_NAME gives it
+func alloyDBConnName(info DBConnectionInfo) string {
+	if info.ConnName != "" {
+		return info.ConnName
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/clusters/%s/instances/%s", info.ProjectID, info.DBRegion, info.DBCluster, info.DBInstance)
+}
+
+// Whether engine connects through the Unix sockets in DB_SOCKET_DIR rather than a connector
+func usesCloudSQLSocket(engine string) bool {
+	return os.Getenv("DB_SOCKET_DIR") != "" && (engine == "CLOUD_SQL_MYSQL" || engine == "CLOUD_SQL_POSTGRES")
+}
+
+// Checks DB_SOCKET_DIR isn't set for a Cloud engine that would ignore it and use its connector,
+// and that with DB_IAM_AUTH the socket is given no password and the IAM user in the form the
+// Auth Proxy logs in as: the service account email without .gserviceaccount.com for Postgres,
+// and only the part before the @ for MySQL.
+func checkDBSocket(engine string) error {
+	if os.Getenv("DB_SOCKET_DIR") == "" || engine == "SQLITE" || engine == "FAKE" {
+		return nil
+	}
+	if !usesCloudSQLSocket(engine) {
+		return fmt.Errorf("%w: DB_SOCKET_DIR is set but %v always connects through its connector", ErrInvalidDBConfig, engine)
+	}
+	if !dbIAMAuth() {
+		return nil
+	}
+	if os.Getenv("DB_PASS") != "" {
+		return fmt.Errorf("%w: DB_PASS is set but DB_IAM_AUTH logs in through DB_SOCKET_DIR without one", ErrInvalidDBConfig)
+	}
+	user := os.Getenv("DB_USER")
+	if user == "" {
+		return nil
+	}
+	switch engine {
+	case "CLOUD_SQL_POSTGRES":
+		if !strings.Contains(user, "@") || strings.HasSuffix(user, ".gserviceaccount.com") {
+			return fmt.Errorf("%w: DB_USER %q is not a Postgres IAM user (expecting the email without .gserviceaccount.com, e.g. decaf@my-project.iam)", ErrInvalidDBConfig, user)
+		}
+	case "CLOUD_SQL_MYSQL":
+		if strings.Contains(user, "@") {
+			return fmt.Errorf("%w: DB_USER %q is not a MySQL IAM user (expecting the part of the email before the @, e.g. decaf)", ErrInvalidDBConfig, user)
+		}
+	}
+	return nil
+}
+
+// The database/sql driver and default DSN for MySQL: the Cloud SQL connector driver, or the plain
+// MySQL driver over the Unix socket when socket is set
+func mySQLDSN(info DBConnectionInfo, socket string) (driverName, dsn string) {
+	driverName, addr := "cloudsql-mysql", fmt.Sprintf("cloudsql-mysql(%s)", cloudSQLConnName(info))
+	if socket != "" {
+		driverName, addr = "mysql", fmt.Sprintf("unix(%s)", socket)
+	}
+	if info.IAMAuth {
+		return driverName, fmt.Sprintf("%s@%s/%s", info.User, addr, info.DBName)
+	}
+	return driverName, fmt.Sprintf("%s:%s@%s/%s", info.User, info.Pass, addr, info.DBName)
+}
+
+// A database/sql connector that counts every connection the pool makes to engine
+type countedConnector struct {
+	driver.Connector
+	engine string
+}
+
+func (c countedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	recordDBConnect(c.engine, err)
+	return conn, err
+}
+
+// A connector for a driver that only opens DSNs
+type dsnConnector struct {
+	dsn string
+	drv driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.drv.Open(c.dsn) }
+func (c dsnConnector) Driver() driver.Driver                        { return c.drv }
+
+// Like sql.Open, but counts each connection to engine rather than only the first
+func openCountedDB(engine, driverName, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	db.Close()
+	var connector driver.Connector = dsnConnector{dsn: dsn, drv: drv}
+	if dc, ok := drv.(driver.DriverContext); ok {
+		if connector, err = dc.OpenConnector(dsn); err != nil {
+			return nil, err
+		}
+	}
+	return sql.OpenDB(countedConnector{Connector: connector, engine: engine}), nil
+}
+
+// Open the MySQL database through the Cloud SQL connector driver, or the Unix socket in
+// DB_SOCKET_DIR, and check it can be reached
+func DDDMySQLOpen(ctx context.Context) (db *sql.DB, err error) {
+	info, err := connectionInfo(ctx)
+	if err != nil {
+		slog.Error("Cannot load database info", "error", err)
+		return db, err
+	}
+	driverName, def := mySQLDSN(info, cloudSQLSocket(info))
+	if err := checkDSNTemplateSSL(info.DSNTemplate); err != nil {
+		return db, err
+	}
+	dsn, err := buildDSN(info, def)
+	if err != nil {
+		slog.Error("Cannot build DSN", "error", err)
+		return db, err
+	}
+
+	db, err = openCountedDB("CLOUD_SQL_MYSQL", driverName, dsn)
+	err = redactPassword(err, info.Pass)
+	if err != nil {
+		slog.Error("failed to connect", "error", err)
+		return db, err
+	}
+	db.SetMaxOpenConns(dbPool.MaxConns)
+	// Keep every open connection for reuse rather than closing all but database/sql's default of 2
+	db.SetMaxIdleConns(dbPool.MaxConns)
+	db.SetConnMaxLifetime(dbPool.MaxConnLifetime)
+	// sql.Open connects lazily, so ping to make the first connection
+	err = redactPassword(db.PingContext(ctx), info.Pass)
+	if err != nil {
+		slog.Error("failed to connect", "error", err)
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// SQL Server logins are SQL Server's own, as it has no IAM database users
+var errSQLServerIAMAuth = errors.New("DB_IAM_AUTH is not supported by Cloud SQL for SQL Server")
+
+// Open the SQL Server database through the Cloud SQL connector driver and check it can be reached
+func DDDSQLServerOpen(ctx context.Context) (db *sql.DB, err error) {
+	info, err := connectionInfo(ctx)
+	if err != nil {
+		slog.Error("Cannot load database info", "error", err)
+		return db, err
+	}
+	if info.IAMAuth {
+		return nil, errSQLServerIAMAuth
+	}
+	// The connector dials the instance named in the cloudsql parameter, so the host is ignored
+	def := (&url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(info.User, info.Pass),
+		Host:     "localhost",
+		RawQuery: url.Values{"database": {info.DBName}, "cloudsql": {cloudSQLConnName(info)}}.Encode(),
+	}).String()
+	if err := checkDSNTemplateSSL(info.DSNTemplate); err != nil {
+		return db, err
+	}
+	dsn, err := buildDSN(info, def)
+	if err != nil {
+		slog.Error("Cannot build DSN", "error", err)
+		return db, err
+	}
+
+	db, err = openCountedDB("CLOUD_SQL_SQLSERVER", "cloudsql-sqlserver", dsn)
+	err = redactPassword(err, info.Pass)
+	if err != nil {
+		slog.Error("failed to connect", "error", err)
+		return db, err
+	}
+	db.SetMaxOpenConns(dbPool.MaxConns)
+	db.SetMaxIdleConns(dbPool.MaxConns)
+	db.SetConnMaxLifetime(dbPool.MaxConnLifetime)
+	// sql.Open connects lazily, so ping to make the first connection
+	err = redactPassword(db.PingContext(ctx), info.Pass)
+	if err != nil {
+		slog.Error("failed to connect", "error", err)
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// What to do with a price that is not a number, from PRICE_PARSE_MODE
+const (
+	// Leave the row out of the total and count it in SkippedRows (default)
+	priceParseSkip = "skip"
+	// Fail the request
+	priceParseError = "error"
+	// Add nothing to the total for the row
+	priceParseZero = "zero"
+)
+
+func priceParseMode() (string, error) {
+	switch mode := strings.ToLower(os.Getenv("PRICE_PARSE_MODE")); mode {
+	case "":
+		return priceParseSkip, nil
+	case priceParseSkip, priceParseError, priceParseZero:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid PRICE_PARSE_MODE %v (expecting skip, error or zero)", os.Getenv("PRICE_PARSE_MODE"))
+	}
+}
+
+// Parses a decimal price such as "3.50" into cents, rounding to the nearest cent. Prices are parsed
+// as text rather than floats so totals are exact.
+func parsePriceCents(price string) (int64, error) {
+	s := strings.TrimSpace(price)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("price %q is empty", price)
+	}
+	for _, part := range []string{whole, frac} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, fmt.Errorf("price %q is not a decimal number", price)
+			}
+		}
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("price %q is out of range", price)
+	}
+	frac += "000"
+	cents := units*100 + int64(frac[0]-'0')*10 + int64(frac[1]-'0')
+	if frac[2] >= '5' {
+		cents++
+	}
+	if neg {
+		cents = -cents
+	}
+	return cents, nil
+}
+
+// A coffee's price, parsed into cents when it's read. Text is kept as the table stores it, which is
+// what the JSON shows, and a price that isn't a number has Valid false so the totals can handle it
+// according to PRICE_PARSE_MODE.
+type Price struct {
+	Cents int64
+	Text  string
+	Valid bool
+}
+
+func parsePrice(text string) Price {
+	cents, err := parsePriceCents(text)
+	return Price{Cents: cents, Text: text, Valid: err == nil}
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Text)
+}
+
+func (p *Price) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err != nil {
 		return err
 	}
-	defer mySQLCleanup()
+	*p = parsePrice(text)
+	return nil
+}
+
+// How prices that are not numbers are handled while totalling one result
+type priceParser struct {
+	// From PRICE_PARSE_MODE
+	Mode string
+	// Most prices that are not numbers the result may have before it fails, from
+	// PRICE_ERROR_BUDGET, or -1 for no limit
+	Budget int
+	// Prices seen so far that are not numbers
+	Invalid int
+}
+
+// Reads PRICE_PARSE_MODE and PRICE_ERROR_BUDGET, which is unset by default for no limit
+func newPriceParser() (*priceParser, error) {
+	mode, err := priceParseMode()
+	if err != nil {
+		return nil, err
+	}
+	p := &priceParser{Mode: mode, Budget: -1}
+	if v := os.Getenv("PRICE_ERROR_BUDGET"); v != "" {
+		p.Budget, err = strconv.Atoi(v)
+		if err != nil || p.Budget < 0 {
+			return nil, fmt.Errorf("invalid PRICE_ERROR_BUDGET %q (expecting a non-negative integer)", v)
+		}
+	}
+	return p, nil
+}
+
+// Adds price to the totals, handling prices that are not numbers according to the mode and
+// failing once there are more of them than the budget allows
+func (p *priceParser) add(result *DDDBondPayload, price Price) error {
+	if price.Valid {
+		result.TotalCents += price.Cents
+		result.Total = int(result.TotalCents / 100)
+		return nil
+	}
+	priceParseFailures.WithLabelValues(p.Mode).Inc()
+	p.Invalid++
+	switch {
+	case p.Mode == priceParseError:
+		return fmt.Errorf("price %q in row %v is not a number", price.Text, result.RowCount)
+	case p.Budget >= 0 && p.Invalid > p.Budget:
+		return fmt.Errorf("%v prices are not numbers, more than PRICE_ERROR_BUDGET allows (%v), the last %q in row %v", p.Invalid, p.Budget, price.Text, result.RowCount)
+	case p.Mode == priceParseSkip:
+		result.SkippedRows++
+	}
+	slog.Warn("Could not convert price to a decimal", "price", price.Text, "mode", p.Mode)
+	return nil
+}
+
+// Open the local SQLite database at DB_PATH, for development without a cloud database
+func DDDSQLiteOpen(ctx context.Context) (*sql.DB, error) {
+	path := os.Getenv("DB_PATH")
+	if path == "" {
+		return nil, fmt.Errorf("%w: DB_PATH not set (required for SQLITE)", ErrMissingDBConfig)
+	}
+	// Open doesn't create the file, so a wrong path fails here rather than querying an empty database
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := openCountedDB("SQLITE", "sqlite", path)
+	if err != nil {
+		slog.Error("failed to connect", "error", err)
+		return nil, err
+	}
+	err = db.PingContext(ctx)
+	if err != nil {
+		slog.Error("failed to connect", "error", err)
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
 
-	return nil
+// How many rows the row loops scan between checks that the request is still wanted
+const ctxCheckInterval = 100
+
+// Process MySQL rows (same for SQLite)
+func DDDMySQLRows(ctx context.Context, db *sql.DB) (result DDDBondPayload, err error) {
+	return sqlRows(ctx, db, dialectMySQL)
 }
 
-func DDDMySQLConnect(ctx context.Context) (result DDDBondPayload, err error) {
+// Process SQL Server rows. There are no aggregate queries for SQL Server, so the rows are always
+// read (see checkSQLAggregate).
+func DDDSQLServerRows(ctx context.Context, db *sql.DB) (result DDDBondPayload, err error) {
+	return sqlRows(ctx, db, dialectSQLServer)
+}
 
-	info, err := dbConnectionInfo()
+// Process the rows of a database/sql database, querying in its dialect
+func sqlRows(ctx context.Context, db *sql.DB, d sqlDialect) (result DDDBondPayload, err error) {
+	start := time.Now()
+	defer func() { result.QueryDurationMs = time.Since(start).Milliseconds() }()
+	if d == dialectMySQL && useSQLAggregate(ctx) {
+		return DDDMySQLAggregate(ctx, db)
+	}
+	prices, err := newPriceParser()
 	if err != nil {
-		log.Printf("Error: Cannot load database info: %v\n", err)
 		return result, err
 	}
-	dsn := fmt.Sprintf("%s:%s@cloudsql-mysql(%s:%s:%s)/%s", info.User, info.Pass, info.ProjectID, info.DBRegion, info.DBInstance, info.DBName)
-
-	db, err := sql.Open(
-		"cloudsql-mysql",
-		dsn)
+	magic, err := magicIndex()
+	if err != nil {
+		return result, err
+	}
+	query, err := coffeeQuery(d)
 	if err != nil {
-		log.Printf("failed to connect: %v\n", err)
 		return result, err
 	}
-	rows, err := db.Query(defaultQuery)
+	query, args := pagedQuery(ctx, query, d)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		log.Printf("query failed: %v\n", err)
+		loggerFrom(ctx).Error("query failed", "error", err)
 		return result, err
 	}
 
 	defer rows.Close()
 
-	var (
-		i     int
-		bean  string
-		price string
-	)
+	columns, err := rows.Columns()
+	if err != nil {
+		return result, err
+	}
+	if err := checkCoffeeColumns(len(columns)); err != nil {
+		return result, err
+	}
+
+	detail := wantCoffeeDetail(ctx)
+	row := sqlCoffeeRow{rows}
 	for rows.Next() {
-		err = rows.Scan(&i, &bean, &price)
-		if err != nil {
-			log.Printf("query failed: %v\n", err)
-			return result, err
+		// Stop scanning if the client has gone away
+		if result.RowCount%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				loggerFrom(ctx).Warn("query abandoned", "rows", result.RowCount, "error", err)
+				return result, err
+			}
 		}
-		if i == 51 {
-			result.MagicCoffee = bean
-		}
-		p, err := strconv.Atoi(strings.Split(price, ".")[0])
+		coffee, err := scanCoffee(row, detail)
 		if err != nil {
-			log.Printf("Could not convert %v to an integer\n", price)
-			continue
+			loggerFrom(ctx).Error("query failed", "error", err)
+			return result, fmt.Errorf("row %v: %w", result.RowCount+1, err)
+		}
+		if err := addCoffeeRow(ctx, &result, prices, magic, detail, coffee); err != nil {
+			return result, err
 		}
-		result.Total += p
 	}
-	return result, nil
+	return endCoffeeRows(ctx, result, magic, rows.Err())
 }
 
 // Create a postgres connection (same for AlloyDB and CloudSQL)
 func DDDPostgresConnection() (c *pgxpool.Config, err error) {
 	info, err := dbConnectionInfo()
 	if err != nil {
-		log.Printf("Error: Cannot load database info: %v\n", err)
+		slog.Error("Cannot load database info", "error", err)
+		return c, err
+	}
+	return postgresConfig(info, "")
+}
+
+// The default Postgres DSN for info, connecting to the Unix socket when socket is set. Without a
+// host, the pool's dialer decides where connections go.
+func postgresDSN(info DBConnectionInfo, socket, ssl string) string {
+	dsn := fmt.Sprintf("user=%s password=%s dbname=%s %s", info.User, info.Pass, info.DBName, ssl)
+	if info.IAMAuth {
+		dsn = fmt.Sprintf("user=%s dbname=%s %s", info.User, info.DBName, ssl)
+	}
+	if socket != "" {
+		// pgx connects to the .s.PGSQL.5432 socket in the directory named by host
+		dsn = fmt.Sprintf("host=%s %s", socket, dsn)
+	}
+	return dsn
+}
+
+// The pgx pool config for info, see postgresDSN
+func postgresConfig(info DBConnectionInfo, socket string) (c *pgxpool.Config, err error) {
+	ssl, err := postgresSSLParams(info.DSNTemplate, socket == "")
+	if err != nil {
+		slog.Error("Invalid SSL settings", "error", err)
+		return c, err
+	}
+	dsn, err := buildDSN(info, postgresDSN(info, socket, ssl))
+	if err != nil {
+		slog.Error("Cannot build DSN", "error", err)
 		return c, err
 	}
-	dsn := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", info.User, info.Pass, info.DBName)
 	c, err = pgxpool.ParseConfig(dsn)
+	err = redactPassword(err, info.Pass)
 	if err != nil {
-		log.Printf("failed to parse pgx config: %v\n", err)
+		slog.Error("failed to parse pgx config", "error", err)
 		return c, err
 	}
+	c.MaxConns = int32(dbPool.MaxConns)
+	c.MinConns = int32(dbPool.MinConns)
+	c.MaxConnLifetime = dbPool.MaxConnLifetime
 	return c, nil
 }
 
-// Connect to AlloyDB
-func DDDAlloyConnect(ctx context.Context) (result DDDBondPayload, err error) {
-	c, err := DDDPostgresConnection()
+// How the connectors reach the database, from DB_IP_TYPE
+const (
+	ipTypePublic  = "PUBLIC"
+	ipTypePrivate = "PRIVATE"
+	// Private Service Connect
+	ipTypePSC = "PSC"
+)
+
+// Validated DB_IP_TYPE, empty when unset (each connector then uses its default)
+func dbIPType() (string, error) {
+	switch t := strings.ToUpper(os.Getenv("DB_IP_TYPE")); t {
+	case "", ipTypePublic, ipTypePrivate, ipTypePSC:
+		return t, nil
+	default:
+		return "", fmt.Errorf("invalid DB_IP_TYPE %v (expecting PUBLIC, PRIVATE or PSC)", os.Getenv("DB_IP_TYPE"))
+	}
+}
+
+// Cloud SQL dial option for DB_IP_TYPE, nil when unset so the connector's default (public IP) applies
+func cloudSQLIPDialOption(ipType string) (cloudsqlconn.DialOption, error) {
+	switch ipType {
+	case ipTypePublic:
+		return cloudsqlconn.WithPublicIP(), nil
+	case ipTypePrivate:
+		return cloudsqlconn.WithPrivateIP(), nil
+	case ipTypePSC:
+		return nil, fmt.Errorf("DB_IP_TYPE PSC is not supported by this version of the Cloud SQL connector")
+	default:
+		return nil, nil
+	}
+}
+
+// Cloud SQL dialer options from the environment, shared by the Postgres dialer and the MySQL driver
+func cloudSQLDialerOptions() (opts []cloudsqlconn.Option, err error) {
+	ipType, err := dbIPType()
 	if err != nil {
-		log.Printf("failed to parse pgx config: %v\n", err)
-		return result, err
+		return nil, err
 	}
-	// Create a new dialer with any options
-	d, err := alloydbconn.NewDialer(ctx)
+	ipOpt, err := cloudSQLIPDialOption(ipType)
 	if err != nil {
-		log.Printf("failed to initialize dialer: %v\n", err)
-		return result, err
+		return nil, err
+	}
+	if ipOpt != nil {
+		opts = append(opts, cloudsqlconn.WithDefaultDialOptions(ipOpt))
+	}
+	if dbIAMAuth() {
+		opts = append(opts, cloudsqlconn.WithIAMAuthN())
 	}
-	defer d.Close()
+	return opts, nil
+}
 
-	info, err := dbConnectionInfo()
-	if err != nil {
-		log.Printf("Error: Cannot load database info: %v\n", err)
-		return result, err
+// Checks DB_TYPE is set to a DB type we can connect to, or FAKE, so a missing or mistyped DB_TYPE
+// stops the app at startup rather than failing every request
+func validateDBType(dbType string) error {
+	if dbType == "" {
+		return fmt.Errorf("%w: DB_TYPE not set (expecting one of %v)", ErrMissingDBConfig, backendEngines(true))
 	}
-	if info.DBCluster == "" {
-		log.Printf("Error: DB_CLUSTER not set (required for alloydb): %v\n", err)
-		return result, fmt.Errorf("expected db cluster to be set")
+	if _, ok := coffeeBackends[dbType]; !ok && dbType != "FAKE" {
+		return fmt.Errorf("%w %v (expecting one of %v)", ErrUnknownDBType, dbType, backendEngines(true))
 	}
+	return nil
+}
 
-	// Tell the driver to use the Cloud SQL Go Connector to create connections
-	c.ConnConfig.DialFunc = func(ctx context.Context, _ string, instance string) (net.Conn, error) {
-		return d.Dial(ctx, fmt.Sprintf("projects/%s/locations/%s/clusters/%s/instances/%s", info.ProjectID, info.DBRegion, info.DBCluster, info.DBInstance))
+// Checks the dialer options (and for Postgres the SSL settings) for the DB type can be built, so
+// bad settings stop the app at startup
+func checkDialerOptions(engine string) (err error) {
+	if err := checkDBSocket(engine); err != nil {
+		return err
+	}
+	switch engine {
+	case "ALLOY_DB":
+		if _, err = postgresSSLParams(os.Getenv("DB_DSN_TEMPLATE"), true); err != nil {
+			return err
+		}
+		_, err = alloyDialerOptions()
+	case "CLOUD_SQL_POSTGRES":
+		if _, err = postgresSSLParams(os.Getenv("DB_DSN_TEMPLATE"), !usesCloudSQLSocket(engine)); err != nil {
+			return err
+		}
+		_, err = cloudSQLDialerOptions()
+	case "CLOUD_SQL_MYSQL":
+		if dbLazyRefresh() {
+			return errLazyRefreshDriver
+		}
+		if err = checkDSNTemplateSSL(os.Getenv("DB_DSN_TEMPLATE")); err != nil {
+			return err
+		}
+		_, err = cloudSQLDialerOptions()
+	case "CLOUD_SQL_SQLSERVER":
+		if dbIAMAuth() {
+			return errSQLServerIAMAuth
+		}
+		if dbLazyRefresh() {
+			return errLazyRefreshDriver
+		}
+		if err = checkDSNTemplateSSL(os.Getenv("DB_DSN_TEMPLATE")); err != nil {
+			return err
+		}
+		_, err = cloudSQLDialerOptions()
+	default:
+		_, err = dbIPType()
 	}
+	return err
+}
 
-	// Interact with the driver directly as you normally would
-	pool, err := pgxpool.ConnectConfig(context.Background(), c)
+// AlloyDB dialer options from the environment.
+// ALLOYDB_REFRESH_TIMEOUT_S bounds how long a certificate refresh may take, and
+// ALLOYDB_TCP_KEEPALIVE_S sets the keepalive period of each connection (0 keeps the connector
+// defaults of 30s for both).
+func alloyDialerOptions() (opts []alloydbconn.Option, err error) {
+	// This version of the AlloyDB connector always connects over private IP
+	ipType, err := dbIPType()
 	if err != nil {
-		log.Printf("failed to connect: %v\n", err)
-		return result, err
+		return nil, err
+	}
+	if ipType == ipTypePublic || ipType == ipTypePSC {
+		return nil, fmt.Errorf("DB_IP_TYPE %v is not supported by this version of the AlloyDB connector, which only connects over private IP", ipType)
+	}
+	if dbIAMAuth() {
+		return nil, fmt.Errorf("DB_IAM_AUTH is not supported by this version of the AlloyDB connector")
+	}
+	t, err := envSeconds("ALLOYDB_REFRESH_TIMEOUT_S", 0)
+	if err != nil {
+		return nil, err
+	}
+	if t > 0 {
+		opts = append(opts, alloydbconn.WithRefreshTimeout(t))
+	}
+	// Shorter keepalives stop idle pool connections being dropped silently by NATs and proxies
+	keepAlive, err := envSeconds("ALLOYDB_TCP_KEEPALIVE_S", 0)
+	if err != nil {
+		return nil, err
+	}
+	if keepAlive > 0 {
+		opts = append(opts, alloydbconn.WithDefaultDialOptions(alloydbconn.WithTCPKeepAlive(keepAlive)))
 	}
-	defer pool.Close()
-	// Consistent for AlloyDB and Postgres
-	return DDDPostgresRows(ctx, pool)
+	return opts, nil
 }
 
-// Connect to CloudSQL Postgres
-func DDDPostgresConnect(ctx context.Context) (result DDDBondPayload, err error) {
-	c, err := DDDPostgresConnection()
+// A failed dial, already counted by countPostgresConnects
+type postgresDialError struct{ error }
+
+func (e postgresDialError) Unwrap() error { return e.error }
+
+// Counts every connection the pool makes to engine, not only its first: failed dials as they
+// happen and connections once they are ready. Call it after DialFunc is set.
+func countPostgresConnects(engine string, c *pgxpool.Config) {
+	dial := c.ConnConfig.DialFunc
+	c.ConnConfig.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			recordDBConnect(engine, err)
+			return nil, postgresDialError{err}
+		}
+		return conn, nil
+	}
+	c.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		recordDBConnect(engine, nil)
+		return nil
+	}
+}
+
+// Counts the pool's first connection failing after it dialled, e.g. a rejected login, which
+// countPostgresConnects can't see
+func recordPostgresPoolConnect(engine string, err error) {
+	var dialErr postgresDialError
+	if err != nil && !errors.As(err, &dialErr) {
+		recordDBConnect(engine, err)
+	}
+}
 
-	// Create a new dialer with any options
-	d, err := cloudsqlconn.NewDialer(context.Background())
+// Create a connection pool to AlloyDB through the connector. The returned cleanup closes the pool.
+func DDDAlloyPool(ctx context.Context) (pool *pgxpool.Pool, cleanup func(), err error) {
+	c, err := DDDPostgresConnection()
 	if err != nil {
-		log.Printf("failed to initialize dialer: %v\n", err)
-		return result, err
+		slog.Error("failed to parse pgx config", "error", err)
+		return nil, nil, err
 	}
-	defer d.Close()
-	info, err := dbConnectionInfo()
+	dial, err := alloyDialFunc()
 	if err != nil {
-		log.Printf("Error: Cannot load database info: %v\n", err)
-		return result, err
+		return nil, nil, err
+	}
+	info, err := connectionInfo(ctx)
+	if err != nil {
+		slog.Error("Cannot load database info", "error", err)
+		return nil, nil, err
+	}
+	if info.DBCluster == "" && info.ConnName == "" {
+		slog.Error("DB_CLUSTER not set (required for alloydb)")
+		return nil, nil, fmt.Errorf("%w: DB_CLUSTER not set (required for ALLOY_DB)", ErrMissingDBConfig)
 	}
-	// Tell the driver to use the Cloud SQL Go Connector to create connections
+
+	// Tell the driver to use the AlloyDB Go Connector to create connections
 	c.ConnConfig.DialFunc = func(ctx context.Context, _ string, instance string) (net.Conn, error) {
-		return d.Dial(ctx, fmt.Sprintf("%s:%s:%s", info.ProjectID, info.DBRegion, info.DBInstance))
+		return dial(ctx, alloyDBConnName(info))
+	}
+	countPostgresConnects("ALLOY_DB", c)
+
+	// ctx bounds the first connection, see sharedPostgresPool
+	pool, err = pgxpool.ConnectConfig(ctx, c)
+	recordPostgresPoolConnect("ALLOY_DB", err)
+	err = redactPassword(err, c.ConnConfig.Password)
+	if err != nil {
+		slog.Error("failed to connect", "error", err)
+		return nil, nil, err
+	}
+	return pool, pool.Close, nil
+}
+
+// Create a connection pool to CloudSQL Postgres through the connector, or the Unix socket in
+// DB_SOCKET_DIR. The returned cleanup closes the pool.
+func DDDCloudSQLPostgresPool(ctx context.Context) (pool *pgxpool.Pool, cleanup func(), err error) {
+	info, err := connectionInfo(ctx)
+	if err != nil {
+		slog.Error("Cannot load database info", "error", err)
+		return nil, nil, err
+	}
+	socket := cloudSQLSocket(info)
+	c, err := postgresConfig(info, socket)
+	if err != nil {
+		return nil, nil, err
+	}
+	if socket == "" {
+		dial, err := cloudSQLDialFunc()
+		if err != nil {
+			return nil, nil, err
+		}
+		// Tell the driver to use the Cloud SQL Go Connector to create connections
+		c.ConnConfig.DialFunc = func(ctx context.Context, _ string, instance string) (net.Conn, error) {
+			return dial(ctx, cloudSQLConnName(info))
+		}
+	}
+	countPostgresConnects("CLOUD_SQL_POSTGRES", c)
+
+	// ctx bounds the first connection, see sharedPostgresPool
+	pool, err = pgxpool.ConnectConfig(ctx, c)
+	recordPostgresPoolConnect("CLOUD_SQL_POSTGRES", err)
+	err = redactPassword(err, c.ConnConfig.Password)
+	if err != nil {
+		slog.Error("failed to connect", "error", err)
+		return nil, nil, err
 	}
+	return pool, pool.Close, nil
+}
+
+// The part of *pgxpool.Pool used to query coffee, so tests can substitute pgxmock
+type pgxQuerier interface {
+	pgxRowQuerier
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
 
-	// Interact with the driver directly as you normally would
-	pool, err := pgxpool.ConnectConfig(context.Background(), c)
+// A row of the coffee query that can be read as the values of its id, bean and price columns,
+// whatever types the driver gives them
+type coffeeRow interface {
+	Values() ([]interface{}, error)
+}
+
+// Reads database/sql rows as a coffeeRow
+type sqlCoffeeRow struct {
+	rows *sql.Rows
+}
+
+func (r sqlCoffeeRow) Values() ([]interface{}, error) {
+	values := make([]interface{}, 3)
+	return values, r.rows.Scan(&values[0], &values[1], &values[2])
+}
+
+// Ends a row loop with the error its rows reported. Next also returns false when reading a row
+// fails, and a partial total must not pass as the whole.
+func endCoffeeRows(ctx context.Context, result DDDBondPayload, magic int, err error) (DDDBondPayload, error) {
 	if err != nil {
-		log.Printf("failed to connect: %v\n", err)
+		loggerFrom(ctx).Error("query failed", "rows", result.RowCount, "error", err)
 		return result, err
 	}
-	defer pool.Close()
-	// Consistent for AlloyDB and Postgres
-	return DDDPostgresRows(ctx, pool)
+	logMagicOutOfRange(ctx, magic, result.RowCount)
+	return result, nil
+}
+
+// Reads the current row of the coffee query, the same way for every driver. NULL beans and prices
+// are read as empty strings, so a NULL price is handled like any other price that isn't a number.
+// The id is only read with withID, since the totals don't need it and a table with NULL or
+// non-integer ids can still be totalled.
+func scanCoffee(row coffeeRow, withID bool) (c Coffee, err error) {
+	values, err := row.Values()
+	if err != nil {
+		return c, err
+	}
+	if len(values) < 3 {
+		return c, fmt.Errorf("expected id, bean and price columns, got %v", len(values))
+	}
+	if withID {
+		id, err := columnText(values[0])
+		if err != nil {
+			return c, fmt.Errorf("id: %w", err)
+		}
+		if c.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+			return c, fmt.Errorf("id %q is not an integer", id)
+		}
+	}
+	if c.Bean, err = columnText(values[1]); err != nil {
+		return c, fmt.Errorf("bean: %w", err)
+	}
+	price, err := columnText(values[2])
+	if err != nil {
+		return c, fmt.Errorf("price: %w", err)
+	}
+	c.Price = parsePrice(price)
+	return c, nil
+}
+
+// Counts coffee, the next row read, into result: its bean is the magic coffee at the magic index,
+// its price goes into the total and, if detail is set, the row itself is kept
+func addCoffeeRow(ctx context.Context, result *DDDBondPayload, prices *priceParser, magic int, detail bool, coffee Coffee) error {
+	if result.RowCount == magic {
+		result.MagicCoffee = coffee.Bean
+	}
+	if detail {
+		if err := addCoffee(ctx, result, coffee); err != nil {
+			return err
+		}
+	}
+	result.RowCount++
+	return prices.add(result, coffee.Price)
+}
+
+// Converts a bean or price column value to text. NULL becomes an empty string and numbers are
+// formatted, so unexpected column types produce an error instead of a panic.
+func columnText(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case []byte:
+		return string(t), nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(t), nil
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	case driver.Valuer:
+		// e.g. pgtype.Numeric, which converts to its text form
+		value, err := t.Value()
+		if err != nil {
+			return "", err
+		}
+		return columnText(value)
+	default:
+		return "", fmt.Errorf("unsupported column type %T", v)
+	}
 }
 
 // Process Pogres rows (same for alloydb and cloud sql)
-func DDDPostgresRows(ctx context.Context, pool *pgxpool.Pool) (result DDDBondPayload, err error) {
-	rows, err := pool.Query(ctx, defaultQuery)
+func DDDPostgresRows(ctx context.Context, pool pgxQuerier) (result DDDBondPayload, err error) {
+	start := time.Now()
+	defer func() { result.QueryDurationMs = time.Since(start).Milliseconds() }()
+	if useSQLAggregate(ctx) {
+		return DDDPostgresAggregate(ctx, pool)
+	}
+	prices, err := newPriceParser()
+	if err != nil {
+		return result, err
+	}
+	magic, err := magicIndex()
+	if err != nil {
+		return result, err
+	}
+	query, err := coffeeQuery(dialectPostgres)
+	if err != nil {
+		return result, err
+	}
+	query, args := pagedQuery(ctx, query, dialectPostgres)
+	rows, err := pool.Query(ctx, query, args...)
 	if err != nil {
-		log.Printf("query failed: %v\n", err)
+		loggerFrom(ctx).Error("query failed", "error", err)
 		return result, err
 	}
 	defer rows.Close()
 
-	i := 0
+	if err := checkCoffeeColumns(len(rows.FieldDescriptions())); err != nil {
+		return result, err
+	}
+	detail := wantCoffeeDetail(ctx)
+
 	for rows.Next() {
-		values, err := rows.Values()
-		if err != nil {
-			log.Printf("query failed: %v\n", err)
-			return result, err
-		}
-		if i == 50 {
-			result.MagicCoffee = values[1].(string)
+		// Stop scanning if the client has gone away
+		if result.RowCount%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				loggerFrom(ctx).Warn("query abandoned", "rows", result.RowCount, "error", err)
+				return result, err
+			}
 		}
-		price := values[2].(string)
-		p, err := strconv.Atoi(strings.Split(price, ".")[0])
+		// pgx.Rows already reads rows as values
+		coffee, err := scanCoffee(rows, detail)
 		if err != nil {
-			log.Printf("Could not convert %v to an integer\n", price)
-			continue
+			loggerFrom(ctx).Error("query failed", "error", err)
+			return result, fmt.Errorf("row %v: %w", result.RowCount+1, err)
+		}
+		if err := addCoffeeRow(ctx, &result, prices, magic, detail, coffee); err != nil {
+			return result, err
 		}
-		result.Total += p
-		i++
 	}
-	return result, nil
+	return endCoffeeRows(ctx, result, magic, rows.Err())
 }
 
 // Chi router to handle incoming GET
 func dddRouter(r chi.Router) {
-	r.Get("/", dddHandler)
+	// Superseded by POST /v2/verify
+	r.With(legacyEndpoint("/v2/verify"), instrumentDDD).Get("/", dddHandler)
 	//r.Post("/cloud_sql_postgres", eventHandler)
 	//r.Post("/cloud_sql_mysql", eventHandler)
 }
 
-func dddHandler(w http.ResponseWriter, r *http.Request) {
+// Shares a single in-flight aggregation between concurrent identical requests
+var dddFlight singleflight.Group
 
-	var result DDDBondPayload
-	var err error
+// How long a shared aggregation may run, as it no longer stops with the request that started it
+const dddFlightTimeout = 2 * time.Minute
 
-	switch os.Getenv("DB_TYPE") {
-	case "ALLOY_DB":
-		result, err = DDDAlloyConnect(r.Context())
-		if err != nil {
-			log.Printf("Data-Driven Decaf: Error: %v\n", err)
-			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+// Called once a caller is waiting on the shared aggregation (swapped out in tests)
+var dddFlightJoined = func() {}
+
+// Runs the coffee aggregation through the given DB type's backend (swapped out in tests)
+var dddConnect = func(ctx context.Context, dbType string) (DDDBondPayload, error) {
+	backend, err := backendFor(dbType)
+	if err != nil {
+		return DDDBondPayload{}, err
+	}
+	return backend.Fetch(ctx)
+}
+
+// The values of a context without its deadline or cancellation
+type detachedContext struct{ context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// Runs the coffee aggregation, collapsing concurrent calls with the same key into one DB query.
+// The query keeps the first caller's values but runs detached from it, bounded by
+// dddFlightTimeout, so one cancelled request doesn't fail the others sharing it. Each caller stops
+// waiting when its own ctx is done. Streamed requests run their own query, as the rows go to the
+// caller's response.
+func dddAggregate(ctx context.Context, dbType string) (DDDBondPayload, error) {
+	if _, ok := coffeeStreamFrom(ctx); ok {
+		return dddConnect(ctx, dbType)
+	}
+	key := dbType
+	if wantCoffeeDetail(ctx) {
+		key += "/detail"
+	}
+	if p, ok := coffeePageFrom(ctx); ok {
+		key += fmt.Sprintf("/limit=%v/offset=%v", p.Limit, p.Offset)
+	}
+	ch := dddFlight.DoChan(key, func() (interface{}, error) {
+		flightCtx, cancel := context.WithTimeout(detachedContext{ctx}, dddFlightTimeout)
+		defer cancel()
+		return dddConnect(flightCtx, dbType)
+	})
+	dddFlightJoined()
+	select {
+	case res := <-ch:
+		if res.Shared {
+			loggerFrom(ctx).Info("Data-Driven Decaf: Shared in-flight aggregation", "db_type", dbType)
+		}
+		// Each caller gets its own rows, as merging Bond's reply can write into them
+		return res.Val.(DDDBondPayload).clone(), res.Err
+	case <-ctx.Done():
+		return DDDBondPayload{}, ctx.Err()
+	}
+}
+
+// Whether result, read with ctx, is from an empty table. Bond has nothing to check in it and may
+// reject its zeros, so an empty result is never sent to Bond. A page only says the table is empty
+// when it starts at the first row and could hold one, so one past the end is just a partial read.
+func emptyResult(ctx context.Context, result DDDBondPayload) bool {
+	if p, paged := coffeePageFrom(ctx); paged && (p.Offset > 0 || p.Limit == 0) {
+		return false
+	}
+	return result.RowCount == 0
+}
+
+// Status to respond with when the coffee table is empty, from EMPTY_RESULT_MODE.
+// "ok" (default) returns 200 with zeros and "empty": true without calling Bond, "not_found" and
+// "unprocessable" fail the request.
+func emptyResultStatus() (int, error) {
+	switch strings.ToLower(os.Getenv("EMPTY_RESULT_MODE")) {
+	case "", "ok":
+		return http.StatusOK, nil
+	case "not_found", "404":
+		return http.StatusNotFound, nil
+	case "unprocessable", "422":
+		return http.StatusUnprocessableEntity, nil
+	default:
+		return 0, fmt.Errorf("invalid EMPTY_RESULT_MODE %v (expecting ok, not_found or unprocessable)", os.Getenv("EMPTY_RESULT_MODE"))
+	}
+}
+
+// Whether RESPONSE_ENVELOPE asks for GET /data_driven_decaf/ to wrap its response in data and meta
+func responseEnvelope() bool {
+	return os.Getenv("RESPONSE_ENVELOPE") == "true"
+}
+
+// A GET /data_driven_decaf/ response with RESPONSE_ENVELOPE set, meta being the same as /v2/verify's
+type dddEnvelope struct {
+	Data DDDBondPayload `json:"data"`
+	Meta v2Meta         `json:"meta"`
+}
+
+// The body of a GET /data_driven_decaf/ response: result itself, or result wrapped in an envelope
+// with RESPONSE_ENVELOPE set. Only the response is wrapped, Bond is always sent the bare payload.
+func dddResponseBody(r *http.Request, start time.Time, result DDDBondPayload) any {
+	if !responseEnvelope() {
+		return result
+	}
+	return dddEnvelope{
+		Data: result,
+		Meta: v2Meta{
+			Engine:      result.DB,
+			Project:     result.Project,
+			RowCount:    result.RowCount,
+			GeneratedAt: jsonTime(time.Now()),
+			DurationMs:  time.Since(start).Milliseconds(),
+			RequestID:   middleware.GetReqID(r.Context()),
+		},
+	}
+}
+
+// Runs the coffee aggregation for the given DB type and adds the details Bond needs to verify it
+func buildPayload(ctx context.Context, engine string) (DDDBondPayload, error) {
+	result, err := dddAggregate(ctx, engine)
+	if err != nil {
+		return result, err
+	}
+	// Add Project ID and DB type to results
+	result.Project = cfg.ProjectID
+	result.DB = engine
+	return result, nil
+}
+
+// Which body GET /data_driven_decaf/ responds with, from ?response=
+const (
+	// The payload we built and sent to Bond (default)
+	dddResponseLocal = "local"
+	// The payload with the fields of Bond's reply merged over it, e.g. a magic coffee Bond corrected
+	dddResponseMerged = "merged"
+)
+
+func dddHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	dbType := selectedDBType
+	l := loggerFrom(r.Context()).With("db_type", dbType)
+	// The database query and Bond call are traced as children of this span
+	ctx, span := startRequestSpan(r, "data_driven_decaf")
+	defer span.End()
+	if r.URL.Query().Get("detail") == "true" {
+		ctx = withCoffeeDetail(ctx)
+	}
+	// NDJSON streams each row as it is scanned, then the response as the last line
+	var stream *ndjsonStream
+	// Logs err and fails the request with the status errorStatus gives it, or ends the stream with
+	// an error line once rows were sent
+	fail := func(msg string, err error, body string) {
+		status := errorStatus(err)
+		if status < http.StatusInternalServerError {
+			l.Warn(msg, "error", err)
+		} else {
+			l.Error(msg, "error", err)
+			spanFailed(span, err)
+		}
+		if stream != nil && stream.started {
+			stream.finish(v2Error{Error: body})
 			return
 		}
-	case "CLOUD_SQL_POSTGRES":
-		result, err = DDDPostgresConnect(r.Context())
+		http.Error(w, body, status)
+	}
+	responseMode := r.URL.Query().Get("response")
+	switch responseMode {
+	case "":
+		responseMode = dddResponseLocal
+	case dddResponseLocal, dddResponseMerged:
+	default:
+		err := fmt.Errorf("%w: response %q is not local or merged", ErrInvalidParam, responseMode)
+		fail("Data-Driven Decaf: Invalid request", err, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	page, ok, err := parseCoffeePage(r.URL.Query())
+	if err != nil {
+		fail("Data-Driven Decaf: Could not read the page", err, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	if ok {
+		ctx = withCoffeePage(ctx, page)
+	}
+	if acceptsNDJSON(r) {
+		stream = newNDJSONStream(w)
+		ctx = withCoffeeStream(withCoffeeDetail(ctx), stream.coffee)
+	}
+
+	result, err := buildPayload(ctx, dbType)
+	if err != nil {
+		fail("Data-Driven Decaf: Could not query", err, fmt.Sprintf("Error: %v", err))
+		return
+	}
+	// An empty table usually means the wrong database, so make it stand out
+	if emptyResult(ctx, result) {
+		l.Warn("Data-Driven Decaf: Empty dataset: no coffee rows returned")
+		emptyResults.WithLabelValues(dbType).Inc()
+		status, err := emptyResultStatus()
 		if err != nil {
-			log.Printf("Data-Driven Decaf: Error: %v\n", err)
-			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+			fail("Data-Driven Decaf: Invalid configuration", err, fmt.Sprintf("Error: %v", err))
 			return
 		}
-	case "CLOUD_SQL_MYSQL":
-		result, err = DDDMySQLConnect(r.Context())
-		if err != nil {
-			log.Printf("Data-Driven Decaf: Error: %v\n", err)
-			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		if status != http.StatusOK {
+			http.Error(w, "Error: empty dataset", status)
 			return
 		}
-	default:
-		// Don't know the DB type, error out
-		log.Printf("Data-Driven Decaf: Unknown DB type %v\n", os.Getenv("DB_TYPE"))
-		http.Error(w, fmt.Sprintf("Error: Unknown DB type %v", os.Getenv("DB_TYPE")), http.StatusInternalServerError)
+		result.Empty = true
+		if stream != nil {
+			stream.finish(dddResponseBody(r, start, result))
+			return
+		}
+		json.NewEncoder(w).Encode(dddResponseBody(r, start, result))
 		return
 	}
-	// Add Project ID and DB type to results
-	result.Project = cfg.ProjectID
-	result.DB = os.Getenv("DB_TYPE")
-
-	log.Printf("Result: %+v", result)
+	l.Info("Data-Driven Decaf: Aggregated", "total", result.Total, "magic_coffee", result.MagicCoffee, "rows", result.RowCount)
 
-	// Verify with Bond Service
-	res, err := sendJson(r.Context(), "/v1/data_driven_decaf/verify", result)
-	if err != nil {
-		if res != nil {
-			log.Printf("Data-Driven Decaf: Error: Body: %v", string(res))
+	// A page from the start that came back short is the whole table
+	if p, paged := coffeePageFrom(ctx); paged && (p.Offset > 0 || result.RowCount >= p.Limit) {
+		l.Info("Data-Driven Decaf: Verification skipped, only a page of the table was read", "limit", p.Limit, "offset", p.Offset)
+		result.Partial = true
+		if stream != nil {
+			stream.finish(dddResponseBody(r, start, result))
+			return
+		}
+		json.NewEncoder(w).Encode(dddResponseBody(r, start, result))
+		return
+	}
+	if skipBond() {
+		l.Info("Data-Driven Decaf: Verification skipped, SKIP_BOND is set")
+		if stream != nil {
+			stream.finish(dddResponseBody(r, start, result))
+			return
 		}
-		log.Printf("Data-Driven Decaf: Error: %v\n", err)
-		http.Error(w, fmt.Sprintf("Data-Driven Decaf Error: %v", err), http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(dddResponseBody(r, start, result))
 		return
 	}
 
-	log.Printf("Response: %v\n", res)
+	// Verify with Bond Service, which only wants the totals and the parameters it asked for
+	bondPayload := result
+	bondPayload.Coffees = nil
+	bondCtx := ctx
+	if params := forwardedParams(r.URL.Query()); bondCfg.VerifyMethod == http.MethodGet {
+		// Kept out of the query, which is logged and traced along the way
+		bondCtx = withBondParamHeaders(ctx, params)
+	} else {
+		bondPayload.Params = params
+	}
+	res, err := callBond(bondCtx, bondCfg.VerifyMethod, bondCfg.VerifyPath, bondPayload)
+	if err != nil {
+		fail("Data-Driven Decaf: Verification failed", err, fmt.Sprintf("Data-Driven Decaf Error: %v", err))
+		return
+	}
+	if err := checkVerifyReply(res); err != nil {
+		fail("Data-Driven Decaf: Not verified", err, fmt.Sprintf("Data-Driven Decaf Error: %v", err))
+		return
+	}
 
-	json.NewEncoder(w).Encode(result)
+	l.Info("Data-Driven Decaf: Verified", "response", string(res))
 
+	if responseMode == dddResponseMerged {
+		// Decoded into a copy so a reply that isn't a JSON object leaves the result untouched
+		merged := result
+		if err := json.Unmarshal(res, &merged); err != nil {
+			l.Warn("Data-Driven Decaf: Could not merge Bond's response, returning our own", "error", err)
+		} else {
+			result = merged
+		}
+	}
+	if stream != nil {
+		stream.finish(dddResponseBody(r, start, result))
+		return
+	}
+	json.NewEncoder(w).Encode(dddResponseBody(r, start, result))
 }
@@ -0,0 +1,167 @@
+// Errors callers can check for with errors.Is and errors.As
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// A required DB_* variable is not set
+	ErrMissingDBConfig = errors.New("missing database configuration")
+	// A DB_* variable is set to something that can't be right, e.g. a DB_REGION that isn't a region
+	ErrInvalidDBConfig = errors.New("invalid database configuration")
+	// DB_TYPE, or the engine asked for, is not one we can connect to
+	ErrUnknownDBType = errors.New("unknown DB type")
+	// Bond replied with a status outside 2xx, see BondError for the details
+	ErrBondUnexpectedStatus = errors.New("unexpected status from Bond")
+	// Bond couldn't be reached, even after retrying
+	ErrBondUnreachable = errors.New("bond unreachable")
+	// Bond answered 2xx with a body we can't use, e.g. a batch reply that isn't an array
+	ErrBondUnexpectedReply = errors.New("unexpected reply from Bond")
+	// Bond checked the result and found it isn't valid, see BondVerifyResponse
+	ErrBondRejected = errors.New("bond rejected the result")
+	// An attempt to reach Bond ran past BOND_TIMEOUT_S, see bondTimeoutError
+	ErrBondTimeout = errors.New("bond timed out")
+	// A new coffee row breaks a constraint on the coffee table, e.g. a duplicate id
+	ErrCoffeeConflict = errors.New("coffee conflicts with an existing row")
+	// ?limit= or ?offset= is not a non-negative integer
+	ErrInvalidPage = errors.New("invalid page")
+	// A query parameter the caller sent can't be used
+	ErrInvalidParam = errors.New("invalid parameter")
+)
+
+// The response status for an error that failed a request: 400 for the caller's mistakes, 422 when
+// Bond says the result isn't valid, 502 when Bond rejects the request, can't be reached or sends a
+// reply we can't use, 503 when the database can't be reached, 504 when either takes too long, and
+// 500 for anything else, such as an unknown DB type or missing configuration
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidPage), errors.Is(err, ErrInvalidParam):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrBondRejected):
+		return http.StatusUnprocessableEntity
+	// Checked before Bond, so a Bond request that timed out is a 504 too
+	case errors.Is(err, ErrBondTimeout), dbErrorCategory(err) == dbOutcomeTimeout:
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrBondUnexpectedStatus), errors.Is(err, ErrBondUnreachable), errors.Is(err, ErrBondUnexpectedReply):
+		return http.StatusBadGateway
+	case dbErrorCategory(err) == dbOutcomeNetwork:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Bond replied with a status outside 2xx. Matches ErrBondUnexpectedStatus with errors.Is.
+type BondError struct {
+	StatusCode int
+	// The start of the response body
+	Body []byte
+	// Requests made, including retries
+	Attempts int
+}
+
+func (e *BondError) Error() string {
+	msg := fmt.Sprintf("expected 200 response, got %v", e.StatusCode)
+	if e.Attempts > 1 {
+		msg += fmt.Sprintf(" after %v attempts", e.Attempts)
+	}
+	if body := bondErrorSummary(e.Body); body != "" {
+		msg += ": " + body
+	}
+	return msg
+}
+
+// Most of Bond's response body quoted in a BondError's message
+const maxBondErrorMessage = 512
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// Bond's response body as one readable line for an error message. JSON is compacted, HTML error
+// pages have their tags removed, and anything longer than maxBondErrorMessage is cut short.
+func bondErrorSummary(body []byte) string {
+	var buf bytes.Buffer
+	if json.Valid(body) && json.Compact(&buf, body) == nil {
+		return truncate(buf.String(), maxBondErrorMessage)
+	}
+	s := string(body)
+	if strings.HasPrefix(http.DetectContentType(body), "text/html") {
+		s = htmlTag.ReplaceAllString(s, " ")
+	}
+	return truncate(strings.Join(strings.Fields(s), " "), maxBondErrorMessage)
+}
+
+// Cuts s to at most n bytes without splitting a UTF-8 character, marking that it was cut
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "... (truncated)"
+}
+
+func (e *BondError) Is(target error) bool {
+	return target == ErrBondUnexpectedStatus
+}
+
+// Bond couldn't be reached after Attempts requests. Matches ErrBondUnreachable with errors.Is, and
+// unwraps to the last request's error.
+type bondRequestError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *bondRequestError) Error() string {
+	return fmt.Sprintf("bond request failed after %v attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *bondRequestError) Unwrap() error { return e.Err }
+
+func (e *bondRequestError) Is(target error) bool {
+	return target == ErrBondUnreachable
+}
+
+// An attempt to reach Bond that got no response, or no whole body, within After
+type bondTimeoutError struct {
+	After time.Duration
+	Err   error
+}
+
+func (e *bondTimeoutError) Error() string {
+	return fmt.Sprintf("no response from bond within %v: %v", e.After, e.Err)
+}
+
+func (e *bondTimeoutError) Unwrap() error { return e.Err }
+
+func (e *bondTimeoutError) Is(target error) bool {
+	return target == ErrBondTimeout
+}
+
+// An error whose message has the database password masked. Unwraps to the original error.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+
+func (e *redactedError) Unwrap() error { return e.err }
+
+// Masks the password wherever err quotes it. Driver errors can echo the DSN, and these errors are
+// logged and returned to callers.
+func redactPassword(err error, pass string) error {
+	if err == nil || pass == "" || !strings.Contains(err.Error(), pass) {
+		return err
+	}
+	return &redactedError{msg: strings.ReplaceAll(err.Error(), pass, "****"), err: err}
+}
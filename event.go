@@ -2,13 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
 	"net/http"
 
 	"github.com/go-chi/chi"
 )
 
+// Storage events from Eventarc and Pub/Sub are a few KB, so anything much bigger isn't one
+const maxEventBodyBytes = 64 << 10
+
 // Subset of what we get from EventArc
 type EventarcPayload struct {
 	Kind    string `json:"kind,omitempty"`
@@ -28,27 +31,34 @@ type PubSubPayload struct {
 }
 
 func eventHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Eventful Day Task: Event received")
+	l := loggerFrom(r.Context())
+	l.Info("Eventful Day Task: Event received")
 
 	var eventarcPayload EventarcPayload
 	var pubSubPayload PubSubPayload
 
-	body, err := io.ReadAll(r.Body)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEventBodyBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		l.Warn("Eventful Day Task: Event too large", "limit_bytes", tooLarge.Limit)
+		http.Error(w, "Event too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
-		log.Printf("Eventful Day Task: Error: %v\n", err)
+		l.Warn("Eventful Day Task: Invalid input", "error", err)
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
 	// Attempt to read as PubSub and Eventarc
 	err = json.Unmarshal(body, &eventarcPayload)
 	if err != nil {
-		log.Printf("Eventful Day Task: Error: %v\n", err)
+		l.Warn("Eventful Day Task: Invalid input", "error", err)
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
 	err = json.Unmarshal(body, &pubSubPayload)
 	if err != nil {
-		log.Printf("Eventful Day Task: Error: %v\n", err)
+		l.Warn("Eventful Day Task: Invalid input", "error", err)
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
@@ -58,20 +68,20 @@ func eventHandler(w http.ResponseWriter, r *http.Request) {
 		// Copy fields from Pubsub to eventarc struct to process later
 		eventarcPayload.Kind = "storage#object"
 		eventarcPayload.Name = pubSubPayload.Message.Attributes.ObjectID
-		log.Println("Eventful Day Task: Got event from PubSub")
+		l.Info("Eventful Day Task: Got event from PubSub")
 	} else {
-		log.Println("Eventful Day Task: Got event from Eventarc")
+		l.Info("Eventful Day Task: Got event from Eventarc")
 	}
 
 	// Ensure it's valid
 	if eventarcPayload.Kind != "storage#object" {
-		log.Printf("Eventful Day Task: Error: invalid kind: %v (expecting storage#object)\n", eventarcPayload.Kind)
+		l.Warn("Eventful Day Task: Invalid kind (expecting storage#object)", "kind", eventarcPayload.Kind)
 		http.Error(w, "Invalid payload", http.StatusBadRequest)
 		return
 	}
 	// Check the name field is populated - this is used for verification later
 	if eventarcPayload.Name == "" {
-		log.Printf("Eventful Day Task: Error: missing Name in payload: %v\n", eventarcPayload)
+		l.Warn("Eventful Day Task: Missing Name in payload", "payload", eventarcPayload)
 		http.Error(w, "Invalid payload", http.StatusBadRequest)
 		return
 	}
@@ -79,19 +89,24 @@ func eventHandler(w http.ResponseWriter, r *http.Request) {
 	// Add the project name to the payload
 	eventarcPayload.Project = cfg.ProjectID
 
-	log.Printf("Eventful Day Task: Storage object \"%v\" in project %v\n", eventarcPayload.Name, eventarcPayload.Project)
+	l.Info("Eventful Day Task: Storage object", "object", eventarcPayload.Name, "project", eventarcPayload.Project)
 
 	// Send payload to bond service for verification
-	log.Println("Eventful Day Task: Verifying event payload with bond service")
+	l.Info("Eventful Day Task: Verifying event payload with bond service")
+
+	if skipBond() {
+		l.Info("Eventful Day Task: Verification skipped, SKIP_BOND is set")
+		return
+	}
 
 	// Verify with Bond Service
 	res, err := sendJson(r.Context(), "/v1/eventful_day/verify", eventarcPayload)
 	if err != nil {
-		log.Printf("Eventful Day Task: Error: %v\n", err)
+		l.Error("Eventful Day Task: Verification failed", "error", err)
 		http.Error(w, "Error validating event", http.StatusInternalServerError)
 		return
 	}
-	log.Printf("Response: %v\n", res)
+	l.Info("Eventful Day Task: Verified", "response", string(res))
 }
 
 // Chi router to handle incoming POST
@@ -0,0 +1,68 @@
+// An in-memory coffee table, DB_TYPE=FAKE, for trying the app and testing handlers without a database
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Rows of the FAKE DB type: Fake-0 to Fake-99, priced 2.50 and 3.00 in turn, which totals 275.00
+// with Fake-50 as the default magic coffee
+var fakeCoffees = func() []Coffee {
+	coffees := make([]Coffee, 100)
+	for i := range coffees {
+		price := "2.50"
+		if i%2 == 1 {
+			price = "3.00"
+		}
+		coffees[i] = Coffee{ID: int64(i + 1), Bean: fmt.Sprintf("Fake-%d", i), Price: parsePrice(price)}
+	}
+	return coffees
+}()
+
+// Aggregates a fixed set of rows the way the row loops do, honouring pages, ?detail=true,
+// MAGIC_INDEX and PRICE_PARSE_MODE. QUERY and SQL_AGGREGATE don't apply.
+type fakeBackend struct {
+	Coffees []Coffee
+}
+
+func (b fakeBackend) Fetch(ctx context.Context) (result DDDBondPayload, err error) {
+	prices, err := newPriceParser()
+	if err != nil {
+		return result, err
+	}
+	magic, err := magicIndex()
+	if err != nil {
+		return result, err
+	}
+	rows := b.Coffees
+	if p, ok := coffeePageFrom(ctx); ok {
+		if p.Offset > len(rows) {
+			p.Offset = len(rows)
+		}
+		rows = rows[p.Offset:]
+		if p.Limit < len(rows) {
+			rows = rows[:p.Limit]
+		}
+	}
+	detail := wantCoffeeDetail(ctx)
+	for _, c := range rows {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if result.RowCount == magic {
+			result.MagicCoffee = c.Bean
+		}
+		if detail {
+			if err := addCoffee(ctx, &result, c); err != nil {
+				return result, err
+			}
+		}
+		result.RowCount++
+		if err := prices.add(&result, c.Price); err != nil {
+			return result, err
+		}
+	}
+	logMagicOutOfRange(ctx, magic, result.RowCount)
+	return result, nil
+}
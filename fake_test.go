@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func Test_FakeBackend(t *testing.T) {
+	useDBType(t, "FAKE")
+	r := chi.NewRouter()
+	r.Route("/data_driven_decaf", dddRouter)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		query       string
+		magicIndex  string
+		emptyMode   string
+		want        DDDBondPayload
+		wantCoffees int
+	}{
+		{name: "all rows", want: DDDBondPayload{MagicCoffee: "Fake-50", Total: 275, TotalCents: 27500, RowCount: 100}},
+		{name: "magic index", magicIndex: "3", want: DDDBondPayload{MagicCoffee: "Fake-3", Total: 275, TotalCents: 27500, RowCount: 100}},
+		{name: "detail", query: "?detail=true", want: DDDBondPayload{MagicCoffee: "Fake-50", Total: 275, TotalCents: 27500, RowCount: 100}, wantCoffees: 100},
+		// Only part of the table, so not verified
+		{name: "page", query: "?limit=3&offset=10", want: DDDBondPayload{Total: 8, TotalCents: 800, RowCount: 3, Partial: true}},
+		{name: "page covering the table", query: "?limit=500", want: DDDBondPayload{MagicCoffee: "Fake-50", Total: 275, TotalCents: 27500, RowCount: 100}},
+		// The table has rows, the page just has none of them
+		{name: "page past the end", query: "?offset=500", want: DDDBondPayload{RowCount: 0, Partial: true}},
+		{name: "page past the end with not_found", query: "?offset=500", emptyMode: "not_found", want: DDDBondPayload{RowCount: 0, Partial: true}},
+		{name: "empty page", query: "?limit=0", emptyMode: "not_found", want: DDDBondPayload{RowCount: 0, Partial: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAGIC_INDEX", tt.magicIndex)
+			t.Setenv("EMPTY_RESULT_MODE", tt.emptyMode)
+			var sent *DDDBondPayload
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != defaultDDDVerifyPath {
+					t.Errorf("Bond called at %v, expected %v", r.URL.Path, defaultDDDVerifyPath)
+				}
+				sent = &DDDBondPayload{}
+				json.NewDecoder(r.Body).Decode(sent)
+				w.Write([]byte(`{"verified":true}`))
+			})
+
+			res, err := http.Get(srv.URL + "/data_driven_decaf/" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status = %v, expected 200", res.StatusCode)
+			}
+			var got DDDBondPayload
+			if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Coffees) != tt.wantCoffees {
+				t.Errorf("got %v coffees, expected %v", len(got.Coffees), tt.wantCoffees)
+			}
+			tt.want.DB = "FAKE"
+			payloads := []*DDDBondPayload{&got}
+			switch {
+			case (tt.want.Empty || tt.want.Partial) && sent != nil:
+				t.Errorf("Bond was sent %+v, expected no call for an empty or partial result", *sent)
+			case !tt.want.Empty && !tt.want.Partial && sent == nil:
+				t.Fatal("Bond was not called")
+			case sent != nil:
+				payloads = append(payloads, sent)
+			}
+			for _, p := range payloads {
+				p.Project, p.QueryDurationMs, p.Coffees = "", 0, nil
+				if !reflect.DeepEqual(*p, tt.want) {
+					t.Errorf("payload = %+v, expected %+v", *p, tt.want)
+				}
+			}
+		})
+	}
+}
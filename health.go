@@ -0,0 +1,142 @@
+// Health checks for Cloud Run and load balancers
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// How long the database check may take before the service is reported unhealthy
+const healthCheckTimeout = 2 * time.Second
+
+type healthResponse struct {
+	Status string `json:"status"`
+	DB     string `json:"db,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// The shared pools' connections, on deep health checks
+	Pools []poolStats `json:"pools,omitempty"`
+}
+
+// Checks the database can be reached through its shared pool, creating the pool if needed
+func pingDB(ctx context.Context, engine string) error {
+	switch engine {
+	case "ALLOY_DB", "CLOUD_SQL_POSTGRES":
+		pool, err := sharedPostgresPool(ctx, engine)
+		if err != nil {
+			return err
+		}
+		return pool.Ping(ctx)
+	case "CLOUD_SQL_MYSQL", "CLOUD_SQL_SQLSERVER", "SQLITE":
+		db, err := sharedSQLDB(ctx, engine)
+		if err != nil {
+			return err
+		}
+		return db.PingContext(ctx)
+	case "FAKE":
+		return nil
+	default:
+		return fmt.Errorf("%w %v", ErrUnknownDBType, engine)
+	}
+}
+
+// Limit on each attempt to reach the database while waiting for it at startup. The first
+// connector dial also fetches certificates, so it gets longer than a health check.
+const dbStartupAttemptTimeout = 10 * time.Second
+
+// Default delay before the second attempt to reach the database at startup, doubled for each
+// further attempt
+const defaultDBStartupRetryDelay = 500 * time.Millisecond
+
+// How long to keep trying to reach the database at startup, from DB_STARTUP_WAIT_S (0, the
+// default, doesn't wait), and the delay between the first attempts from DB_STARTUP_RETRY_DELAY_MS
+func dbStartupWait() (wait time.Duration, delay time.Duration, err error) {
+	wait, err = envSeconds("DB_STARTUP_WAIT_S", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	delay = defaultDBStartupRetryDelay
+	if v := os.Getenv("DB_STARTUP_RETRY_DELAY_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return 0, 0, fmt.Errorf("invalid DB_STARTUP_RETRY_DELAY_MS %q (expecting a positive number of milliseconds)", v)
+		}
+		delay = time.Duration(ms) * time.Millisecond
+	}
+	return wait, delay, nil
+}
+
+// Pings the database until it answers or wait runs out, with the same backoff and jitter as
+// Bond retries starting from delay, logging each failed attempt. Returns the last error.
+func waitForDB(ctx context.Context, engine string, wait, delay time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, dbStartupAttemptTimeout)
+		err := pingDB(attemptCtx, engine)
+		cancelAttempt()
+		if err == nil {
+			slog.Info("Database is reachable", "db_type", engine, "attempt", attempt)
+			return nil
+		}
+		backoff := bondBackoff(attempt, delay)
+		slog.Warn("Waiting for the database", "db_type", engine, "error", err, "attempt", attempt, "retry_in_ms", backoff.Milliseconds())
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database not reachable after %v attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Reports whether the service can reach its database. ?deep=false skips the database check
+// for liveness probes that only need to know the process is serving.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("deep") == "false" {
+		writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+		return
+	}
+	engine := os.Getenv("DB_TYPE")
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := pingDB(ctx, engine); err != nil {
+		loggerFrom(r.Context()).Error("Health: Cannot reach database", "db_type", engine, "error", err)
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "error", DB: engine, Error: err.Error(), Pools: sharedPoolStats()})
+		return
+	}
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok", DB: engine, Pools: sharedPoolStats()})
+}
+
+// Whether the app has finished starting and should be sent traffic. Set once startup is done and
+// cleared when shutdown starts, so /readyz fails while draining.
+var ready atomic.Bool
+
+// Answers 200 while the process is serving at all, for liveness probes. Doesn't touch the
+// database, so a database outage doesn't get the instance restarted.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// Answers 200 only once startup has finished and SELECT 1 succeeds on the database, for
+// readiness probes, so traffic isn't routed to an instance still waiting for its database
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	engine := os.Getenv("DB_TYPE")
+	if !ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "starting", DB: engine})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := selectOne(ctx, engine); err != nil {
+		loggerFrom(r.Context()).Error("Readiness: Cannot query database", "db_type", engine, "error", err)
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "error", DB: engine, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok", DB: engine})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_HealthzHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coffee.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("create table coffee (id integer primary key, bean text, price text)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	tests := []struct {
+		name       string
+		dbType     string
+		dbPath     string
+		target     string
+		wantStatus int
+		wantDB     string
+	}{
+		{name: "reachable", dbType: "SQLITE", dbPath: path, target: "/healthz", wantStatus: http.StatusOK, wantDB: "SQLITE"},
+		{name: "unreachable", dbType: "SQLITE", dbPath: filepath.Join(t.TempDir(), "missing.db"), target: "/healthz", wantStatus: http.StatusServiceUnavailable, wantDB: "SQLITE"},
+		{name: "unknown DB type", dbType: "ORACLE", target: "/healthz", wantStatus: http.StatusServiceUnavailable, wantDB: "ORACLE"},
+		{name: "shallow", dbType: "ORACLE", target: "/healthz?deep=false", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useDBType(t, tt.dbType)
+			t.Setenv("DB_PATH", tt.dbPath)
+			t.Cleanup(closePools)
+
+			rec := httptest.NewRecorder()
+			healthzHandler(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, expected %v (body %s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			var res healthResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.DB != tt.wantDB {
+				t.Errorf("db = %q, expected %q", res.DB, tt.wantDB)
+			}
+		})
+	}
+}
+
+func Test_WaitForDB(t *testing.T) {
+	useDBType(t, "SQLITE")
+	t.Cleanup(closePools)
+
+	// The database file only appears once the first attempts have failed
+	path := filepath.Join(t.TempDir(), "coffee.db")
+	t.Setenv("DB_PATH", path)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db, err := sql.Open("sqlite", path)
+		if err != nil {
+			return
+		}
+		db.Exec("create table coffee (id integer primary key, bean text, price text)")
+		db.Close()
+	}()
+	if err := waitForDB(context.Background(), "SQLITE", 5*time.Second, 10*time.Millisecond); err != nil {
+		t.Errorf("waitForDB error = %v, expected the database to come up", err)
+	}
+
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "missing.db"))
+	closePools()
+	start := time.Now()
+	err := waitForDB(context.Background(), "SQLITE", 100*time.Millisecond, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "not reachable after") {
+		t.Errorf("waitForDB error = %v, expected it to give up", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("waitForDB took %v, expected it to give up after 100ms", d)
+	}
+}
+
+func Test_DBStartupWait(t *testing.T) {
+	tests := []struct {
+		wait      string
+		delay     string
+		wantWait  time.Duration
+		wantDelay time.Duration
+		wantErr   bool
+	}{
+		{wantDelay: defaultDBStartupRetryDelay},
+		{wait: "30", delay: "250", wantWait: 30 * time.Second, wantDelay: 250 * time.Millisecond},
+		{wait: "soon", wantErr: true},
+		{wait: "30", delay: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("DB_STARTUP_WAIT_S", tt.wait)
+		t.Setenv("DB_STARTUP_RETRY_DELAY_MS", tt.delay)
+		wait, delay, err := dbStartupWait()
+		if (err != nil) != tt.wantErr || wait != tt.wantWait || delay != tt.wantDelay && !tt.wantErr {
+			t.Errorf("dbStartupWait with %q, %q = %v, %v, %v, expected %v, %v (wantErr %v)", tt.wait, tt.delay, wait, delay, err, tt.wantWait, tt.wantDelay, tt.wantErr)
+		}
+	}
+}
+
+func Test_ReadyzHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coffee.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("create table coffee (id integer primary key, bean text, price text)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	useDBType(t, "SQLITE")
+
+	tests := []struct {
+		name       string
+		ready      bool
+		dbPath     string
+		wantStatus int
+		wantState  string
+	}{
+		{name: "starting", dbPath: path, wantStatus: http.StatusServiceUnavailable, wantState: "starting"},
+		{name: "ready", ready: true, dbPath: path, wantStatus: http.StatusOK, wantState: "ok"},
+		{name: "database unreachable", ready: true, dbPath: filepath.Join(t.TempDir(), "missing.db"), wantStatus: http.StatusServiceUnavailable, wantState: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DB_PATH", tt.dbPath)
+			t.Cleanup(closePools)
+			ready.Store(tt.ready)
+			t.Cleanup(func() { ready.Store(false) })
+
+			rec := httptest.NewRecorder()
+			readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			var res healthResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantStatus || res.Status != tt.wantState {
+				t.Errorf("response = %v %s, expected %v with status %q", rec.Code, rec.Body, tt.wantStatus, tt.wantState)
+			}
+
+			// Liveness doesn't depend on either
+			rec = httptest.NewRecorder()
+			livezHandler(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("/livez status = %v, expected 200", rec.Code)
+			}
+		})
+	}
+}
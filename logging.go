@@ -0,0 +1,141 @@
+// Structured JSON logging in the format Cloud Logging understands
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"golang.org/x/exp/slog"
+)
+
+type loggerKey struct{}
+
+type traceKey struct{}
+
+// Trace headers passed on from an incoming request to Bond, so a request can be followed across
+// services: Cloud Trace's own header and W3C Trace Context
+var traceHeaders = []string{"X-Cloud-Trace-Context", "traceparent", "tracestate"}
+
+// Log level from LOG_LEVEL: debug, info (default), warn or error
+func logLevel() (slog.Level, error) {
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid LOG_LEVEL %v (expecting debug, info, warn or error)", os.Getenv("LOG_LEVEL"))
+	}
+}
+
+// Renames slog's level and msg keys to the severity and message keys Cloud Logging reads
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		a.Key = "severity"
+		if a.Value.Any().(slog.Level) == slog.LevelWarn {
+			a.Value = slog.StringValue("WARNING")
+		}
+	case slog.MessageKey:
+		a.Key = "message"
+	}
+	return a
+}
+
+// Sends all logging, including the log package's, to stdout as JSON. What's left of the log
+// package is only used to stop the app, so it is logged at error level.
+func initLogging() {
+	level, err := logLevel()
+	h := slog.HandlerOptions{Level: level, ReplaceAttr: cloudLoggingAttr}.NewJSONHandler(os.Stdout)
+	slog.SetDefault(slog.New(h))
+	log.SetFlags(0)
+	log.SetOutput(slog.NewLogLogger(h, slog.LevelError).Writer())
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Adds attributes to every log line from here on. SetDefault points the log package at the new
+// handler at info level, so it is put back to error level.
+func withLogAttrs(args ...any) {
+	l := slog.Default().With(args...)
+	slog.SetDefault(l)
+	log.SetOutput(slog.NewLogLogger(l.Handler(), slog.LevelError).Writer())
+}
+
+// The request's logger, or the default logger outside a request
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// Gives each request a logger carrying its request ID, endpoint and Cloud Trace ID, and logs the
+// request once it completes
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		l := slog.Default().With("request_id", middleware.GetReqID(r.Context()), "endpoint", r.Method+" "+r.URL.Path)
+		// X-Cloud-Trace-Context is TRACE_ID/SPAN_ID;o=OPTIONS
+		if trace, _, _ := strings.Cut(r.Header.Get("X-Cloud-Trace-Context"), "/"); trace != "" && cfg.ProjectID != "" {
+			l = l.With("logging.googleapis.com/trace", fmt.Sprintf("projects/%v/traces/%v", cfg.ProjectID, trace))
+		}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+		l.Info("Request", "status", ww.Status(), "bytes", ww.BytesWritten(), "duration_ms", time.Since(start).Milliseconds())
+	})
+}
+
+// Returns the request's ID in the X-Request-Id response header, so a client can quote it when
+// reporting a problem. The ID is the caller's own X-Request-Id if it sent one, otherwise the one
+// middleware.RequestID made up, and is the request_id of the request's log lines.
+func requestIDHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			w.Header().Set(middleware.RequestIDHeader, id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Keeps the request's trace headers in its context so outgoing requests can carry them
+func traceContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := http.Header{}
+		for _, key := range traceHeaders {
+			if v := r.Header.Get(key); v != "" {
+				h.Set(key, v)
+			}
+		}
+		if len(h) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), traceKey{}, h))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Adds the trace headers and request ID of the request behind ctx to an outgoing request's headers
+func setTraceHeaders(ctx context.Context, h http.Header) {
+	if trace, ok := ctx.Value(traceKey{}).(http.Header); ok {
+		for key, v := range trace {
+			h[key] = v
+		}
+	}
+	if id := middleware.GetReqID(ctx); id != "" {
+		h.Set(middleware.RequestIDHeader, id)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/middleware"
+	"golang.org/x/exp/slog"
+)
+
+func Test_RequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.HandlerOptions{ReplaceAttr: cloudLoggingAttr}.NewJSONHandler(&buf)))
+	t.Cleanup(func() { slog.SetDefault(orig) })
+	origCfg := cfg
+	cfg.ProjectID = "test-project"
+	t.Cleanup(func() { cfg = origCfg })
+
+	h := middleware.RequestID(requestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loggerFrom(r.Context()).Warn("Handler", "db_type", "SQLITE")
+		w.WriteHeader(http.StatusTeapot)
+	})))
+	req := httptest.NewRequest(http.MethodGet, "/data_driven_decaf", nil)
+	req.Header.Set("X-Cloud-Trace-Context", "abc123/1;o=1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var lines []map[string]any
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("log output is not JSON: %v", err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, expected 2", len(lines))
+	}
+	for _, line := range lines {
+		if line["request_id"] == nil || line["request_id"] == "" {
+			t.Errorf("line %v has no request_id", line)
+		}
+		if got := line["endpoint"]; got != "GET /data_driven_decaf" {
+			t.Errorf("endpoint = %v, expected GET /data_driven_decaf", got)
+		}
+		if got := line["logging.googleapis.com/trace"]; got != "projects/test-project/traces/abc123" {
+			t.Errorf("trace = %v, expected projects/test-project/traces/abc123", got)
+		}
+	}
+	if got := lines[0]["severity"]; got != "WARNING" {
+		t.Errorf("severity = %v, expected WARNING", got)
+	}
+	if got := lines[0]["message"]; got != "Handler" {
+		t.Errorf("message = %v, expected Handler", got)
+	}
+	if got := lines[1]["status"]; got != float64(http.StatusTeapot) {
+		t.Errorf("status = %v, expected %v", got, http.StatusTeapot)
+	}
+}
+
+func Test_WithLogAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	orig, origOut := slog.Default(), log.Writer()
+	slog.SetDefault(slog.New(slog.HandlerOptions{ReplaceAttr: cloudLoggingAttr}.NewJSONHandler(&buf)))
+	t.Cleanup(func() {
+		slog.SetDefault(orig)
+		log.SetOutput(origOut)
+	})
+
+	withLogAttrs("instance", "i-1")
+	log.Print("Stopping")
+
+	var line map[string]any
+	if err := json.NewDecoder(&buf).Decode(&line); err != nil {
+		t.Fatal(err)
+	}
+	if got := line["severity"]; got != "ERROR" {
+		t.Errorf("severity = %v, expected ERROR", got)
+	}
+	if got := line["instance"]; got != "i-1" {
+		t.Errorf("instance = %v, expected i-1", got)
+	}
+}
+
+func Test_RequestIDHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		inbound string
+	}{
+		{name: "generated"},
+		{name: "caller's own", inbound: "order-42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			orig := slog.Default()
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&buf)))
+			t.Cleanup(func() { slog.SetDefault(orig) })
+
+			h := middleware.RequestID(requestIDHeader(requestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))))
+			req := httptest.NewRequest(http.MethodGet, "/data_driven_decaf/", nil)
+			if tt.inbound != "" {
+				req.Header.Set(middleware.RequestIDHeader, tt.inbound)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			got := rec.Header().Get(middleware.RequestIDHeader)
+			if got == "" || (tt.inbound != "" && got != tt.inbound) {
+				t.Errorf("X-Request-Id = %q, expected %q or a generated ID", got, tt.inbound)
+			}
+			var line map[string]any
+			if err := json.NewDecoder(&buf).Decode(&line); err != nil {
+				t.Fatal(err)
+			}
+			if line["request_id"] != got {
+				t.Errorf("logged request_id = %v, expected the X-Request-Id %q", line["request_id"], got)
+			}
+		})
+	}
+}
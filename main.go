@@ -2,14 +2,24 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/exp/slog"
 )
 
 // Store configuration globally
@@ -18,11 +28,34 @@ var cfg config
 const (
 	defaultPort       = "8080"
 	defaultCollection = "bond"
+	// Time given to in-flight requests to finish on shutdown. Cloud Run allows 10 seconds after SIGTERM.
+	defaultShutdownGrace = 10 * time.Second
+	// Server timeouts. Writing allows for Cloud Run's default 5 minute request timeout, as a
+	// Data-Driven Decaf request can spend a while retrying Bond.
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 5 * time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
 )
 
 type config struct {
-	Port      string
+	// Address the server listens on, from HOST and PORT
+	Addr      string
 	ProjectID string
+	// Identifies this instance in responses and logs, empty unless INCLUDE_INSTANCE_ID is set
+	InstanceID string
+	// How jsonTime fields are serialised: rfc3339, unix or unixms
+	TimeFormat string
+	// Deprecation and Sunset header values for legacy endpoints, empty when not configured
+	Deprecation string
+	Sunset      string
+	// How long shutdown waits for in-flight requests before closing the pools anyway
+	ShutdownGrace time.Duration
+	// http.Server timeouts
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
 }
 
 type AppInstance struct {
@@ -30,11 +63,29 @@ type AppInstance struct {
 	Team      string `json:"team"`
 }
 
-func initConfig(ctx context.Context) {
+// The address to listen on, from PORT (default 8080, set by Cloud Run) and HOST (default all
+// interfaces)
+func listenAddr() (string, error) {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = defaultPort
 	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid PORT %q (expecting a number from 1 to 65535)", port)
+	}
+	host := os.Getenv("HOST")
+	if strings.ContainsAny(host, "/ ") || strings.Count(host, ":") == 1 {
+		return "", fmt.Errorf("invalid HOST %q (expecting a host name or IP address without a port)", host)
+	}
+	// Brackets an IPv6 address
+	return net.JoinHostPort(strings.Trim(host, "[]"), port), nil
+}
+
+func initConfig(ctx context.Context) {
+	addr, err := listenAddr()
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	// Obtain Project ID from metadata server unless specified
 	projectID := os.Getenv("PROJECT_ID")
@@ -45,26 +96,23 @@ func initConfig(ctx context.Context) {
 		projectID = os.Getenv("DEVSHELL_PROJECT_ID")
 	}
 	if projectID == "" {
-		log.Println("Fetching Project ID from metadata server")
+		slog.Info("Fetching Project ID from metadata server")
 		metadataURL := "http://metadata.google.internal/computeMetadata/v1/project/project-id"
 		// Send a GET request to the metadata server
 		// Do this to make it super-simple for CEs to deploy
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
 		if err != nil {
-			log.Printf("Warning - could not retrieve project ID from metadata server")
-			log.Fatalln(err)
+			log.Fatalf("Could not retrieve project ID from metadata server: %v\n", err)
 		}
 		req.Header.Set("Metadata-Flavor", "Google")
 		client := http.Client{}
 		res, err := client.Do(req)
 		if err != nil {
-			log.Printf("Warning - could not retrieve project ID from metadata server")
-			log.Fatalln(err)
+			log.Fatalf("Could not retrieve project ID from metadata server: %v\n", err)
 		}
 		b, err := io.ReadAll(res.Body)
 		if err != nil {
-			log.Printf("Warning - could not retrieve project ID from metadata server")
-			log.Fatalln(err)
+			log.Fatalf("Could not retrieve project ID from metadata server: %v\n", err)
 		}
 		projectID = string(b)
 	}
@@ -72,59 +120,399 @@ func initConfig(ctx context.Context) {
 		log.Fatalf("Expected PROJECT_ID environment variable to be set")
 	}
 
-	log.Printf("Running in project: %v\n", projectID)
+	slog.Info("Running in project", "project", projectID)
+
+	// Tag logs with the instance so behaviour can be traced across an autoscaled fleet
+	var instanceID string
+	if os.Getenv("INCLUDE_INSTANCE_ID") == "true" {
+		instanceID = instanceIdentity()
+		withLogAttrs("instance", instanceID)
+		slog.Info("Tagging logs with the instance ID", "instance", instanceID)
+	}
+
+	timeFormat := os.Getenv("TIME_FORMAT")
+	switch timeFormat {
+	case "":
+		timeFormat = timeFormatRFC3339
+	case timeFormatRFC3339, timeFormatUnix, timeFormatUnixMs:
+	default:
+		log.Fatalf("Invalid TIME_FORMAT %v (expecting rfc3339, unix or unixms)", timeFormat)
+	}
+
+	deprecation, sunset, err := legacyHeaders()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	shutdownGrace, err := envSeconds("SHUTDOWN_GRACE_S", defaultShutdownGrace)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var readHeaderTimeout, readTimeout, writeTimeout, idleTimeout time.Duration
+	for _, t := range []struct {
+		key string
+		def time.Duration
+		dst *time.Duration
+	}{
+		{"HTTP_READ_HEADER_TIMEOUT_S", defaultReadHeaderTimeout, &readHeaderTimeout},
+		{"HTTP_READ_TIMEOUT_S", defaultReadTimeout, &readTimeout},
+		{"HTTP_WRITE_TIMEOUT_S", defaultWriteTimeout, &writeTimeout},
+		{"HTTP_IDLE_TIMEOUT_S", defaultIdleTimeout, &idleTimeout},
+	} {
+		if *t.dst, err = envSeconds(t.key, t.def); err != nil {
+			log.Fatalln(err)
+		}
+	}
 
 	cfg = config{
-		Port:      port,
-		ProjectID: projectID,
+		Addr:              addr,
+		ProjectID:         projectID,
+		InstanceID:        instanceID,
+		TimeFormat:        timeFormat,
+		Deprecation:       deprecation,
+		Sunset:            sunset,
+		ShutdownGrace:     shutdownGrace,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// Deprecation (RFC 9745) and Sunset (RFC 8594) header values from LEGACY_DEPRECATED_AT and
+// LEGACY_SUNSET_AT, which take RFC3339 times ("true" is also accepted for LEGACY_DEPRECATED_AT)
+func legacyHeaders() (deprecation string, sunset string, err error) {
+	if v := os.Getenv("LEGACY_DEPRECATED_AT"); v == "true" {
+		deprecation = "true"
+	} else if v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid LEGACY_DEPRECATED_AT %v (expecting an RFC3339 time or true)", v)
+		}
+		deprecation = "@" + strconv.FormatInt(t.Unix(), 10)
+	}
+	if v := os.Getenv("LEGACY_SUNSET_AT"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid LEGACY_SUNSET_AT %v (expecting an RFC3339 time)", v)
+		}
+		sunset = t.UTC().Format(http.TimeFormat)
+	}
+	return deprecation, sunset, nil
+}
+
+// Marks a legacy endpoint: adds the configured Deprecation and Sunset headers with a link to its
+// successor, and logs and counts every use so migration can be tracked
+func legacyEndpoint(successor string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cfg.Deprecation != "" {
+				w.Header().Set("Deprecation", cfg.Deprecation)
+				w.Header().Set("Link", fmt.Sprintf("<%v>; rel=\"successor-version\"", successor))
+			}
+			if cfg.Sunset != "" {
+				w.Header().Set("Sunset", cfg.Sunset)
+			}
+			legacyRequests.WithLabelValues(r.Method + " " + r.URL.Path).Inc()
+			loggerFrom(r.Context()).Warn("Legacy endpoint used", "user_agent", r.UserAgent(), "successor", successor)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+const (
+	timeFormatRFC3339 = "rfc3339"
+	timeFormatUnix    = "unix"
+	timeFormatUnixMs  = "unixms"
+)
+
+// A time that serialises to JSON in the configured TIME_FORMAT
+type jsonTime time.Time
+
+func (t jsonTime) MarshalJSON() ([]byte, error) {
+	switch cfg.TimeFormat {
+	case timeFormatUnix:
+		return []byte(strconv.FormatInt(time.Time(t).Unix(), 10)), nil
+	case timeFormatUnixMs:
+		return []byte(strconv.FormatInt(time.Time(t).UnixMilli(), 10)), nil
+	default:
+		return time.Time(t).UTC().MarshalJSON()
+	}
+}
+
+// Identifies this instance from the Cloud Run revision and the container hostname
+func instanceIdentity() string {
+	var parts []string
+	for _, key := range []string{"K_REVISION", "HOSTNAME"} {
+		if v := os.Getenv(key); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	if len(parts) == 0 {
+		return "unknown"
+	}
+	return strings.Join(parts, "/")
+}
+
+// Adds the instance ID to every response
+func instanceIDHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Instance-Id", cfg.InstanceID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Turns a panic in a handler into a 500 with a JSON error, logging the stack with the request's
+// details. http.ErrAbortHandler is passed on, as net/http uses it to abort a response on purpose.
+func recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			loggerFrom(r.Context()).Error("Panic handling request", "panic", fmt.Sprint(rec), "stack", string(debug.Stack()))
+			writeJSON(w, http.StatusInternalServerError, v2Error{Error: "internal server error"})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reads a whole number of seconds from an environment variable, returning def when unset
+func envSeconds(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %v %q (expecting a non-negative number of seconds)", key, v)
 	}
+	return time.Duration(n) * time.Second, nil
 }
 
 func intro(ctx context.Context) {
-	log.Printf("Registering with bond service at %v\n", bondCfg.BondURL)
+	slog.Info("Registering with bond service", "bond_url", bondCfg.BondURL)
 	ai := AppInstance{
 		ProjectID: cfg.ProjectID,
 	}
 	body, err := sendJson(ctx, "/v1/intro", ai)
 	if err != nil {
 		if body != nil {
-			log.Printf("Response from Bond: %v\n", string(body))
+			slog.Error("Response from Bond", "body", string(body))
 		}
-		log.Println("Your project must be registered. Please register here: go/techday-reg")
+		slog.Error("Your project must be registered. Please register here: go/techday-reg")
 		log.Fatalf("Could not register with Bond Service: %v\n", err)
 	}
-	log.Printf("Bond Service Replied: %v\n", string(body))
+	slog.Info("Bond Service Replied", "body", string(body))
 }
 
 func main() {
-	ctx := context.Background()
+	// Cancelled on SIGTERM, which Cloud Run sends before stopping the container
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	initLogging()
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "JSON or YAML file with the database and Bond settings")
+	validate := flag.Bool("validate", os.Getenv("VALIDATE_ONLY") == "true", "Check the database and Bond can be reached, then exit without serving")
+	flag.Parse()
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
 	initConfig(ctx)
+	resolveSecrets(ctx)
 	initBond()
-	intro(ctx)
-	DDDInit()
+	// Validating shouldn't register the project with Bond, just check it can be reached
+	if skipBond() {
+		slog.Warn("SKIP_BOND is set: not registering with Bond, and Data-Driven Decaf results are not verified")
+	} else if !*validate {
+		intro(ctx)
+	}
+	initMetrics()
+	shutdownTracing, err := initTracing(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	initAdmin()
+	initPoolSize()
+	if err := selectBackend(os.Getenv("DB_TYPE")); err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := coffeeQuery(dialectMySQL); err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := magicIndex(); err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := newPriceParser(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkSQLAggregate(os.Getenv("DB_TYPE")); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkDBLocation(os.Getenv("DB_TYPE")); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkDialerOptions(os.Getenv("DB_TYPE")); err != nil {
+		log.Fatalln(err)
+	}
+	if err := checkAdminQuery(os.Getenv("DB_TYPE")); err != nil {
+		log.Fatalln(err)
+	}
+	dbWait, dbRetryDelay, err := dbStartupWait()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	closeDrivers, err := DDDInit()
+	if err != nil {
+		// SQLite, the fake backend and Cloud SQL through DB_SOCKET_DIR don't use the connectors, so
+		// can do without them
+		if dbType := os.Getenv("DB_TYPE"); dbType != "SQLITE" && dbType != "FAKE" && !usesCloudSQLSocket(dbType) {
+			log.Fatalln(err)
+		}
+		closeDrivers = func() {}
+	}
+	if *validate {
+		if dbWait > 0 {
+			if err := waitForDB(ctx, os.Getenv("DB_TYPE"), dbWait, dbRetryDelay); err != nil {
+				slog.Error("Validating without the database", "error", err)
+			}
+		}
+		err := validateConfig(ctx)
+		closePools()
+		closeDrivers()
+		if err != nil {
+			log.Fatalf("Configuration is invalid: %v\n", err)
+		}
+		slog.Info("Configuration is valid")
+		return
+	}
+	startVerifyJob(ctx)
 
 	// TODO - register with bond service on startup!
 
-	log.Print("Starting server...")
+	slog.Info("Starting server...")
+
+	cors, err := corsPolicyFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	limiter, err := rateLimiterFromEnv()
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
+	r.Use(requestIDHeader)
+	// Before RealIP, so the rate limiter can key on the connection's address
+	r.Use(peerAddr)
 	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(requestLogger)
+	// Inside requestLogger, so the 500 is logged with the request
+	r.Use(recoverer)
+	r.Use(traceContext)
+	r.Use(cors.handler)
+	if cfg.InstanceID != "" {
+		r.Use(instanceIDHeader)
+	}
 
-	r.Get("/", defaultHandler)
+	// The original hello endpoint, superseded like GET /data_driven_decaf/ by POST /v2/verify
+	r.With(legacyEndpoint("/v2/verify")).Get("/", defaultHandler)
+	r.Handle("/metrics", promhttp.Handler())
+	r.Get("/healthz", healthzHandler)
+	r.Get("/livez", livezHandler)
+	r.Get("/readyz", readyzHandler)
 
 	// Eventful Day Story
 	r.Route("/eventful_day", eventfulDayRouter)
 
-	// Data-Driven Decaf
-	r.Route("/data_driven_decaf", dddRouter)
+	// Endpoints that query the database, rate limited if configured
+	r.Group(func(r chi.Router) {
+		if limiter != nil {
+			slog.Info("Rate limiting database endpoints", "rps", float64(limiter.RPS), "burst", limiter.Burst, "per_ip", limiter.PerIP)
+			r.Use(limiter.handler)
+		}
+
+		// Data-Driven Decaf
+		r.Route("/data_driven_decaf", dddRouter)
+
+		// Verification API v2
+		r.Post("/v2/verify", v2VerifyHandler)
+		r.Post("/v2/verify/batch", v2VerifyBatchHandler)
+
+		// Add to the coffee table, only for admins and only when enabled
+		if adminCfg.CoffeeOn {
+			r.With(adminAuth).Post("/coffee", newCoffeeHandler)
+		}
+
+		// Admin endpoints, only with admin tokens configured
+		if len(adminCfg.Tokens) > 0 {
+			r.Route("/admin", adminRouter)
+		}
+	})
+
+	// The resolved configuration, for admins debugging a deployment
+	if adminCfg.ConfigOn {
+		r.With(adminAuth).Get("/config", configHandler)
+	}
 
 	// Start HTTP server.
-	log.Printf("Listening on port %s", cfg.Port)
-	if err := http.ListenAndServe(":"+cfg.Port, r); err != nil {
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           r,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	drained := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		slog.Info("Shutting down...", "grace_s", cfg.ShutdownGrace.Seconds())
+		ready.Store(false)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Could not drain requests", "error", err)
+		}
+		close(drained)
+	}()
+	// Listen before waiting for the database, so probes get an answer while it wakes up
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Listening", "addr", cfg.Addr)
+	go func() {
+		// A database that is still waking up would fail the first requests, so /readyz fails until
+		// it has had time to answer. If it still can't, /readyz's own query keeps failing until it can.
+		if dbWait > 0 {
+			if err := waitForDB(ctx, os.Getenv("DB_TYPE"), dbWait, dbRetryDelay); err != nil {
+				slog.Error("Starting without the database", "error", err)
+			}
+		}
+		seedFromFile(ctx)
+		if ctx.Err() == nil {
+			ready.Store(true)
+		}
+	}()
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-drained
+	closePools()
+	closeDrivers()
+	// Flush the last spans, within the grace period too
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("Could not flush traces", "error", err)
+	}
 }
 
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/exp/slog"
 )
 
 type QAPayload struct {
@@ -63,3 +73,131 @@ func Test_QAChapter(t *testing.T) {
 		})
 	}
 }
+
+func Test_JSONTime(t *testing.T) {
+	ts := jsonTime(time.Date(2023, 3, 14, 9, 26, 53, 589000000, time.UTC))
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: timeFormatRFC3339, want: `"2023-03-14T09:26:53.589Z"`},
+		{format: timeFormatUnix, want: `1678786013`},
+		{format: timeFormatUnixMs, want: `1678786013589`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			cfg.TimeFormat = tt.format
+			got, err := ts.MarshalJSON()
+			if err != nil {
+				t.Errorf("MarshalJSON error = %v", err)
+				return
+			}
+			if string(got) != tt.want {
+				t.Errorf("MarshalJSON = %s, expected %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Recoverer(t *testing.T) {
+	var buf bytes.Buffer
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf)))
+	t.Cleanup(func() { slog.SetDefault(orig) })
+
+	h := middleware.RequestID(requestLogger(recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var values []interface{}
+		_ = values[1].(string)
+	}))))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/data_driven_decaf/", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %v, expected %v", rec.Code, http.StatusInternalServerError)
+	}
+	var body v2Error
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == "" {
+		t.Errorf("body = %s, expected a JSON error", rec.Body)
+	}
+
+	var line map[string]any
+	if err := json.NewDecoder(&buf).Decode(&line); err != nil {
+		t.Fatal(err)
+	}
+	if line["request_id"] == nil || line["request_id"] == "" {
+		t.Errorf("panic logged without a request_id: %v", line)
+	}
+	if stack, _ := line["stack"].(string); !strings.Contains(stack, "Test_Recoverer") {
+		t.Errorf("stack = %q, expected it to include the handler", stack)
+	}
+}
+
+func Test_RecovererAbortHandler(t *testing.T) {
+	h := recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("recovered %v, expected http.ErrAbortHandler to be passed on", rec)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func Test_ListenAddr(t *testing.T) {
+	tests := []struct {
+		host    string
+		port    string
+		want    string
+		wantErr bool
+	}{
+		{want: ":8080"},
+		{port: "9090", want: ":9090"},
+		{host: "127.0.0.1", port: "8081", want: "127.0.0.1:8081"},
+		{host: "localhost", want: "localhost:8080"},
+		{host: "::1", want: "[::1]:8080"},
+		{host: "[::1]", want: "[::1]:8080"},
+		{port: "http", wantErr: true},
+		{port: "0", wantErr: true},
+		{port: "65536", wantErr: true},
+		{host: "localhost:8080", wantErr: true},
+		{host: "http://localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("HOST", tt.host)
+		t.Setenv("PORT", tt.port)
+		got, err := listenAddr()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("listenAddr() with HOST=%q PORT=%q error = %v, wantErr %v", tt.host, tt.port, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("listenAddr() with HOST=%q PORT=%q = %q, expected %q", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func Test_LegacyRootEndpoint(t *testing.T) {
+	origCfg := cfg
+	cfg.Deprecation, cfg.Sunset = "@1767225600", "Wed, 01 Jul 2026 00:00:00 GMT"
+	t.Cleanup(func() { cfg = origCfg })
+
+	h := legacyEndpoint("/v2/verify")(http.HandlerFunc(defaultHandler))
+	before := testutil.ToFloat64(legacyRequests.WithLabelValues("GET /"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := rec.Header().Get("Deprecation"); got != cfg.Deprecation {
+		t.Errorf("Deprecation = %q, expected %q", got, cfg.Deprecation)
+	}
+	if got := rec.Header().Get("Sunset"); got != cfg.Sunset {
+		t.Errorf("Sunset = %q, expected %q", got, cfg.Sunset)
+	}
+	if got := rec.Header().Get("Link"); got != `</v2/verify>; rel="successor-version"` {
+		t.Errorf("Link = %q, expected the successor", got)
+	}
+	if got := testutil.ToFloat64(legacyRequests.WithLabelValues("GET /")) - before; got != 1 {
+		t.Errorf("legacy_requests_total{endpoint=\"GET /\"} grew by %v, expected 1", got)
+	}
+}
@@ -0,0 +1,159 @@
+// Prometheus metrics served on /metrics
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	ocprom "contrib.go.opencensus.io/exporter/prometheus"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Connection attempts to the database, labelled by DB type and outcome (see dbErrorCategory)
+var dbConnectAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "db_connect_attempts_total",
+	Help: "Database connection attempts by engine and outcome.",
+}, []string{"engine", "outcome"})
+
+// Requests to legacy endpoints, to track migration off them
+var legacyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "legacy_requests_total",
+	Help: "Requests to deprecated endpoints.",
+}, []string{"endpoint"})
+
+// Prices that could not be parsed, by PRICE_PARSE_MODE
+var priceParseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "price_parse_failures_total",
+	Help: "Coffee rows whose price is not a number.",
+}, []string{"mode"})
+
+// Data-Driven Decaf requests, labelled by DB type and response status code
+var dddRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ddd_requests_total",
+	Help: "Data-Driven Decaf requests by engine and status code.",
+}, []string{"engine", "code"})
+
+var dddRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "ddd_request_duration_seconds",
+	Help:    "Time taken to serve Data-Driven Decaf requests, including the Bond call.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"engine"})
+
+// Time taken by the coffee query and reading its rows, not including connecting
+var dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "db_query_duration_seconds",
+	Help:    "Time taken to run the coffee query and read its rows.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"engine"})
+
+// Failed coffee queries, labelled by DB type and error category (see dbErrorCategory)
+var dbQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "db_query_errors_total",
+	Help: "Failed coffee queries by engine and error category.",
+}, []string{"engine", "category"})
+
+// Coffee queries that returned no rows, which usually means the wrong database
+var emptyResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "empty_results_total",
+	Help: "Coffee queries that returned no rows.",
+}, []string{"engine"})
+
+// Time taken by calls to Bond including retries, labelled by endpoint and outcome:
+// success, status_error (Bond replied outside 2xx) or request_error (Bond could not be reached)
+var bondRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "bond_request_duration_seconds",
+	Help:    "Time taken by calls to Bond, including retries.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"endpoint", "outcome"})
+
+// Runs of the background verification job, labelled by outcome: verified, empty, skipped,
+// query_error, rejected or bond_error
+var verifyJobRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "verify_job_runs_total",
+	Help: "Background verification job runs by engine and outcome.",
+}, []string{"engine", "outcome"})
+
+// Connections in each shared pool, read from the pools whenever /metrics is scraped
+type poolStatsCollector struct{}
+
+var (
+	poolConnectionsDesc = prometheus.NewDesc("db_pool_connections",
+		"Connections in the shared pool by state: idle or in_use.", []string{"pool", "state"}, nil)
+	poolWaitsDesc = prometheus.NewDesc("db_pool_waits_total",
+		"Times a request had to wait for a connection from the shared pool.", []string{"pool"}, nil)
+	poolWaitSecondsDesc = prometheus.NewDesc("db_pool_wait_seconds_total",
+		"Time requests spent waiting for a connection from the shared pool.", []string{"pool"}, nil)
+)
+
+func (poolStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolConnectionsDesc
+	ch <- poolWaitsDesc
+	ch <- poolWaitSecondsDesc
+}
+
+func (poolStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range sharedPoolStats() {
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(s.Idle), s.Pool, "idle")
+		ch <- prometheus.MustNewConstMetric(poolConnectionsDesc, prometheus.GaugeValue, float64(s.InUse), s.Pool, "in_use")
+		ch <- prometheus.MustNewConstMetric(poolWaitsDesc, prometheus.CounterValue, float64(s.WaitCount), s.Pool)
+		ch <- prometheus.MustNewConstMetric(poolWaitSecondsDesc, prometheus.CounterValue, s.WaitDuration.Seconds(), s.Pool)
+	}
+}
+
+// Counts a connection attempt to the given DB type
+func recordDBConnect(engine string, err error) {
+	dbConnectAttempts.WithLabelValues(engine, dbErrorCategory(err)).Inc()
+}
+
+// Exports the OpenCensus metrics recorded by the Cloud SQL and AlloyDB connectors (dial latency,
+// open connections, dial failures and certificate refreshes) through the default Prometheus registry
+func initMetrics() {
+	_, err := ocprom.NewExporter(ocprom.Options{
+		Registry: prometheus.DefaultRegisterer.(*prometheus.Registry),
+	})
+	if err != nil {
+		log.Fatalf("Could not export connector metrics: %v\n", err)
+	}
+	prometheus.MustRegister(dbConnectAttempts, legacyRequests, priceParseFailures, dddRequests, dddRequestDuration,
+		dbQueryDuration, dbQueryErrors, emptyResults, bondRequestDuration, verifyJobRuns, poolStatsCollector{})
+}
+
+// Records the duration of a coffee query that started at start, and its error if it failed
+func observeQuery(engine string, start time.Time, err error) {
+	dbQueryDuration.WithLabelValues(engine).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dbQueryErrors.WithLabelValues(engine, dbErrorCategory(err)).Inc()
+	}
+}
+
+// Records the duration and outcome of a call to Bond that started at start
+func observeBond(endpoint string, start time.Time, err error) {
+	outcome := "success"
+	if errors.Is(err, ErrBondUnexpectedStatus) {
+		outcome = "status_error"
+	} else if err != nil {
+		outcome = "request_error"
+	}
+	bondRequestDuration.WithLabelValues(endpoint, outcome).Observe(time.Since(start).Seconds())
+}
+
+// Counts Data-Driven Decaf requests and how long they take, labelled with the configured DB type
+func instrumentDDD(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		engine := os.Getenv("DB_TYPE")
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		dddRequests.WithLabelValues(engine, strconv.Itoa(status)).Inc()
+		dddRequestDuration.WithLabelValues(engine).Observe(time.Since(start).Seconds())
+	})
+}
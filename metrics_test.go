@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func Test_InstrumentDDD(t *testing.T) {
+	useDBType(t, "SQLITE")
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		code    string
+	}{
+		{
+			name:    "implicit ok",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("{}")) },
+			code:    "200",
+		},
+		{
+			name: "error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Error: empty dataset", http.StatusNotFound)
+			},
+			code: "404",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(dddRequests.WithLabelValues("SQLITE", tt.code))
+			instrumentDDD(tt.handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/data_driven_decaf/", nil))
+			if got := testutil.ToFloat64(dddRequests.WithLabelValues("SQLITE", tt.code)) - before; got != 1 {
+				t.Errorf("ddd_requests_total{code=%q} rose by %v, expected 1", tt.code, got)
+			}
+		})
+	}
+}
+
+func Test_SendJsonObservesBond(t *testing.T) {
+	stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/bad" {
+			http.Error(w, "bad", http.StatusBadRequest)
+		}
+	})
+	tests := []struct {
+		endpoint string
+		outcome  string
+	}{
+		{endpoint: "/v1/good", outcome: "success"},
+		{endpoint: "/v1/bad", outcome: "status_error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.outcome, func(t *testing.T) {
+			before := histogramCount(t, tt.endpoint, tt.outcome)
+			sendJson(context.Background(), tt.endpoint, nil)
+			if n := histogramCount(t, tt.endpoint, tt.outcome) - before; n != 1 {
+				t.Errorf("bond_request_duration_seconds{endpoint=%q,outcome=%q} count rose by %v, expected 1", tt.endpoint, tt.outcome, n)
+			}
+		})
+	}
+}
+
+// Number of observations in the Bond duration histogram for one endpoint and outcome
+func histogramCount(t *testing.T, endpoint, outcome string) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := bondRequestDuration.WithLabelValues(endpoint, outcome).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,95 @@
+// Streams the coffee rows as newline-delimited JSON, for Accept: application/x-ndjson
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// Rows written between flushes, so clients see progress without a flush per row
+const ndjsonFlushRows = 100
+
+// Whether the request's Accept header asks for NDJSON
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+type coffeeStreamKey struct{}
+
+// Asks the row loops to hand every row to fn as it is scanned, instead of collecting them in
+// DDDBondPayload.Coffees. Used with withCoffeeDetail.
+func withCoffeeStream(ctx context.Context, fn func(Coffee) error) context.Context {
+	return context.WithValue(ctx, coffeeStreamKey{}, fn)
+}
+
+func coffeeStreamFrom(ctx context.Context) (func(Coffee) error, bool) {
+	fn, ok := ctx.Value(coffeeStreamKey{}).(func(Coffee) error)
+	return fn, ok
+}
+
+// Streams a row if the request has a stream, otherwise collects it in the result
+func addCoffee(ctx context.Context, result *DDDBondPayload, c Coffee) error {
+	if stream, ok := coffeeStreamFrom(ctx); ok {
+		return stream(c)
+	}
+	result.Coffees = append(result.Coffees, c)
+	return nil
+}
+
+// Writes one JSON value per line. The status and headers are only sent with the first line, so
+// a request that fails before any row was scanned can still get an error status.
+type ndjsonStream struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	lines   int
+	started bool
+}
+
+func newNDJSONStream(w http.ResponseWriter) *ndjsonStream {
+	return &ndjsonStream{w: w, enc: json.NewEncoder(w)}
+}
+
+func (s *ndjsonStream) write(v any) error {
+	if !s.started {
+		s.w.Header().Set("Content-Type", ndjsonContentType)
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+	if err := s.enc.Encode(v); err != nil {
+		return err
+	}
+	s.lines++
+	if s.lines%ndjsonFlushRows == 0 {
+		s.flush()
+	}
+	return nil
+}
+
+func (s *ndjsonStream) flush() {
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Writes a coffee row
+func (s *ndjsonStream) coffee(c Coffee) error {
+	return s.write(c)
+}
+
+// Ends the stream with the response body, or with an error line once rows have been sent and
+// the status can no longer change
+func (s *ndjsonStream) finish(v any) {
+	s.write(v)
+	s.flush()
+}
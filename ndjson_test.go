@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_DDDHandlerNDJSON(t *testing.T) {
+	db := sqliteCoffee(t, 250)
+	stubDDDConnect(t, func(ctx context.Context, dbType string) (DDDBondPayload, error) {
+		return DDDMySQLRows(ctx, db)
+	})
+
+	tests := []struct {
+		name       string
+		accept     string
+		bondStatus int
+		wantLines  int
+		wantError  bool
+	}{
+		{name: "ndjson", accept: "application/x-ndjson", bondStatus: http.StatusOK, wantLines: 251},
+		{name: "ndjson among others", accept: "application/json;q=0.5, application/x-ndjson", bondStatus: http.StatusOK, wantLines: 251},
+		{name: "bond fails after the rows", accept: "application/x-ndjson", bondStatus: http.StatusBadRequest, wantLines: 251, wantError: true},
+		{name: "json", accept: "application/json", bondStatus: http.StatusOK, wantLines: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bondBody DDDBondPayload
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&bondBody)
+				w.WriteHeader(tt.bondStatus)
+			})
+			req := httptest.NewRequest(http.MethodGet, "/data_driven_decaf/", nil)
+			req.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+			dddHandler(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %v, expected 200 (body %s)", rec.Code, rec.Body)
+			}
+
+			var lines []string
+			sc := bufio.NewScanner(rec.Body)
+			for sc.Scan() {
+				lines = append(lines, sc.Text())
+			}
+			if len(lines) != tt.wantLines {
+				t.Fatalf("got %v lines, expected %v", len(lines), tt.wantLines)
+			}
+			// Every line but the last is a row, in table order
+			for i, line := range lines[:len(lines)-1] {
+				var c Coffee
+				if err := json.Unmarshal([]byte(line), &c); err != nil {
+					t.Fatalf("line %v: %v", i+1, err)
+				}
+				if c.ID != int64(i+1) {
+					t.Fatalf("line %v has id %v, expected %v", i+1, c.ID, i+1)
+				}
+			}
+			last := []byte(lines[len(lines)-1])
+			if tt.wantError {
+				var e v2Error
+				if err := json.Unmarshal(last, &e); err != nil || !strings.Contains(e.Error, "400") {
+					t.Errorf("last line = %s, expected an error mentioning Bond's 400", last)
+				}
+				return
+			}
+			var got DDDBondPayload
+			if err := json.Unmarshal(last, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.RowCount != 250 || got.MagicCoffee != "Bean-50" || len(got.Coffees) != 0 {
+				t.Errorf("last line = %+v, expected 250 rows, magic coffee Bean-50 and no coffees", got)
+			}
+			if len(bondBody.Coffees) != 0 {
+				t.Errorf("Bond was sent %v coffees, expected none", len(bondBody.Coffees))
+			}
+			if tt.wantLines > 1 && rec.Header().Get("Content-Type") != ndjsonContentType {
+				t.Errorf("Content-Type = %q, expected %v", rec.Header().Get("Content-Type"), ndjsonContentType)
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+// Database connection pools shared by every request for the life of the process
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/alloydbconn"
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/exp/slog"
+	"golang.org/x/sync/singleflight"
+)
+
+type postgresPool struct {
+	pool *pgxpool.Pool
+	// Closes the pool, leaving the shared dialer open
+	cleanup func()
+}
+
+var (
+	// Guards the pool maps. It's never held while a pool connects, so a database that hangs doesn't
+	// hold up requests for other pools or the health checks reading sharedPoolStats.
+	poolsMu       sync.Mutex
+	postgresPools = map[string]postgresPool{}
+	sqlDBs        = map[string]*sql.DB{}
+	// Has concurrent first requests for a pool create a single pool between them
+	poolFlight singleflight.Group
+)
+
+// How long creating a pool may take, its first connection included. The pool outlives the request
+// that creates it, so this deadline is the pool's own rather than the request's.
+const poolConnectTimeout = 30 * time.Second
+
+// Dialers shared by every AlloyDB and Cloud SQL Postgres pool for the life of the process, so the
+// connectors' auth and instance discovery happen once rather than with each new pool. DDDInit
+// creates the one DB_TYPE needs and its cleanup closes them.
+var (
+	dialersMu      sync.Mutex
+	alloyDialer    *alloydbconn.Dialer
+	cloudSQLDialer *cloudsqlconn.Dialer
+)
+
+// Returns the shared AlloyDB dialer, creating it on first use
+func sharedAlloyDialer() (*alloydbconn.Dialer, error) {
+	dialersMu.Lock()
+	defer dialersMu.Unlock()
+	if alloyDialer != nil {
+		return alloyDialer, nil
+	}
+	opts, err := alloyDialerOptions()
+	if err != nil {
+		slog.Error("Cannot load AlloyDB dialer options", "error", err)
+		return nil, err
+	}
+	d, err := alloydbconn.NewDialer(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Created shared dialer", "db_type", "ALLOY_DB")
+	alloyDialer = d
+	return d, nil
+}
+
+// Returns the shared Cloud SQL dialer, creating it on first use
+func sharedCloudSQLDialer() (*cloudsqlconn.Dialer, error) {
+	dialersMu.Lock()
+	defer dialersMu.Unlock()
+	if cloudSQLDialer != nil {
+		return cloudSQLDialer, nil
+	}
+	opts, err := cloudSQLDialerOptions()
+	if err != nil {
+		slog.Error("Cannot load Cloud SQL dialer options", "error", err)
+		return nil, err
+	}
+	d, err := cloudsqlconn.NewDialer(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Created shared dialer", "db_type", "CLOUD_SQL_POSTGRES")
+	cloudSQLDialer = d
+	return d, nil
+}
+
+// Dials an instance through one of the connectors
+type connectorDialFunc func(ctx context.Context, instance string) (net.Conn, error)
+
+// How AlloyDB connections are made: through the shared dialer, or with DB_LAZY_REFRESH by
+// lazyAlloyDial
+func alloyDialFunc() (connectorDialFunc, error) {
+	if dbLazyRefresh() {
+		return lazyAlloyDial, nil
+	}
+	d, err := sharedAlloyDialer()
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, instance string) (net.Conn, error) {
+		return d.Dial(ctx, instance)
+	}, nil
+}
+
+// How Cloud SQL Postgres connections are made: through the shared dialer, or with
+// DB_LAZY_REFRESH by lazyCloudSQLDial
+func cloudSQLDialFunc() (connectorDialFunc, error) {
+	if dbLazyRefresh() {
+		return lazyCloudSQLDial, nil
+	}
+	d, err := sharedCloudSQLDialer()
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, instance string) (net.Conn, error) {
+		return d.Dial(ctx, instance)
+	}, nil
+}
+
+// The connector versions in use have no lazy refresh option, so with DB_LAZY_REFRESH each
+// connection gets a dialer of its own, which fetches a certificate as it connects and is closed
+// once it has, leaving nothing to refresh in the background. Open connections outlive it. The RSA
+// key is generated once, as generating one per dialer would hold up every connection.
+func lazyAlloyDial(ctx context.Context, instance string) (net.Conn, error) {
+	opts, err := alloyDialerOptions()
+	if err != nil {
+		return nil, err
+	}
+	key, err := lazyRefreshKey()
+	if err != nil {
+		return nil, err
+	}
+	d, err := alloydbconn.NewDialer(ctx, append(opts, alloydbconn.WithRSAKey(key))...)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Dial(ctx, instance)
+}
+
+// The Cloud SQL counterpart of lazyAlloyDial
+func lazyCloudSQLDial(ctx context.Context, instance string) (net.Conn, error) {
+	opts, err := cloudSQLDialerOptions()
+	if err != nil {
+		return nil, err
+	}
+	key, err := lazyRefreshKey()
+	if err != nil {
+		return nil, err
+	}
+	d, err := cloudsqlconn.NewDialer(ctx, append(opts, cloudsqlconn.WithRSAKey(key))...)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Dial(ctx, instance)
+}
+
+var (
+	lazyKeyOnce sync.Once
+	lazyKey     *rsa.PrivateKey
+	lazyKeyErr  error
+)
+
+// The RSA key of the DB_LAZY_REFRESH dialers, generated on first use
+func lazyRefreshKey() (*rsa.PrivateKey, error) {
+	lazyKeyOnce.Do(func() {
+		lazyKey, lazyKeyErr = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	return lazyKey, lazyKeyErr
+}
+
+// Closes the shared dialers. Call it once the pools using them are closed.
+func closeDialers() {
+	dialersMu.Lock()
+	defer dialersMu.Unlock()
+	if alloyDialer != nil {
+		if err := alloyDialer.Close(); err != nil {
+			slog.Warn("Could not close the AlloyDB dialer", "error", err)
+		}
+		alloyDialer = nil
+	}
+	if cloudSQLDialer != nil {
+		if err := cloudSQLDialer.Close(); err != nil {
+			slog.Warn("Could not close the Cloud SQL dialer", "error", err)
+		}
+		cloudSQLDialer = nil
+	}
+}
+
+// Creates a Postgres pool for the given DB type (swapped out in tests)
+var newPostgresPool = func(ctx context.Context, engine string) (*pgxpool.Pool, func(), error) {
+	switch engine {
+	case "ALLOY_DB":
+		return DDDAlloyPool(ctx)
+	case "CLOUD_SQL_POSTGRES":
+		return DDDCloudSQLPostgresPool(ctx)
+	default:
+		return nil, nil, fmt.Errorf("%w %v (expecting a Postgres DB type)", ErrUnknownDBType, engine)
+	}
+}
+
+// The name a pool is shared under: the DB type, with /read for its read replica
+func poolKey(ctx context.Context, engine string) string {
+	if wantReadReplica(ctx) {
+		return engine + "/read"
+	}
+	return engine
+}
+
+// Runs create for the pool under key once between concurrent callers, with a context of the
+// pool's own bounded by poolConnectTimeout that keeps only whether ctx wants the read replica.
+// Each caller stops waiting when its own ctx is done, leaving the pool to finish for the next.
+func createPool(ctx context.Context, key string, create func(ctx context.Context) error) error {
+	ch := poolFlight.DoChan(key, func() (interface{}, error) {
+		poolCtx, cancel := context.WithTimeout(context.Background(), poolConnectTimeout)
+		defer cancel()
+		if wantReadReplica(ctx) {
+			poolCtx = withReadReplica(poolCtx)
+		}
+		return nil, create(poolCtx)
+	})
+	select {
+	case res := <-ch:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns the shared pool for an AlloyDB or Cloud SQL Postgres DB type, creating it on first use.
+// The read replica gets a pool of its own when ctx asks for it (see withReadReplica).
+// A pool that fails to connect is not cached, so the next request tries again.
+func sharedPostgresPool(ctx context.Context, engine string) (*pgxpool.Pool, error) {
+	key := poolKey(ctx, engine)
+	lookup := func() (*pgxpool.Pool, bool) {
+		poolsMu.Lock()
+		defer poolsMu.Unlock()
+		p, ok := postgresPools[key]
+		return p.pool, ok
+	}
+	if pool, ok := lookup(); ok {
+		return pool, nil
+	}
+	err := createPool(ctx, "postgres/"+key, func(poolCtx context.Context) error {
+		// Another caller may have just finished creating it
+		if _, ok := lookup(); ok {
+			return nil
+		}
+		pool, cleanup, err := newPostgresPool(poolCtx, engine)
+		if err != nil {
+			return err
+		}
+		slog.Info("Created shared connection pool", "db_type", engine, "pool", key)
+		poolsMu.Lock()
+		postgresPools[key] = postgresPool{pool: pool, cleanup: cleanup}
+		poolsMu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if pool, ok := lookup(); ok {
+		return pool, nil
+	}
+	// Closed by closePools as soon as it was created
+	return nil, fmt.Errorf("the %v pool was closed", key)
+}
+
+// Returns the shared handle for a database/sql DB type (Cloud SQL MySQL or SQLite), opening it on
+// first use like sharedPostgresPool. Cloud SQL MySQL's read replica gets a handle of its own when
+// ctx asks for it.
+func sharedSQLDB(ctx context.Context, engine string) (*sql.DB, error) {
+	key := poolKey(ctx, engine)
+	lookup := func() (*sql.DB, bool) {
+		poolsMu.Lock()
+		defer poolsMu.Unlock()
+		db, ok := sqlDBs[key]
+		return db, ok
+	}
+	if db, ok := lookup(); ok {
+		return db, nil
+	}
+	err := createPool(ctx, "sql/"+key, func(poolCtx context.Context) error {
+		if _, ok := lookup(); ok {
+			return nil
+		}
+		var (
+			db  *sql.DB
+			err error
+		)
+		switch engine {
+		case "CLOUD_SQL_MYSQL":
+			db, err = DDDMySQLOpen(poolCtx)
+		case "CLOUD_SQL_SQLSERVER":
+			db, err = DDDSQLServerOpen(poolCtx)
+		case "SQLITE":
+			db, err = DDDSQLiteOpen(poolCtx)
+		default:
+			err = fmt.Errorf("%w %v (expecting a database/sql DB type)", ErrUnknownDBType, engine)
+		}
+		if err != nil {
+			return err
+		}
+		slog.Info("Created shared connection pool", "db_type", engine, "pool", key)
+		poolsMu.Lock()
+		sqlDBs[key] = db
+		poolsMu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if db, ok := lookup(); ok {
+		return db, nil
+	}
+	return nil, fmt.Errorf("the %v pool was closed", key)
+}
+
+// Closes every shared pool, waiting for connections in use to be released
+func closePools() {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	for key, p := range postgresPools {
+		p.cleanup()
+		delete(postgresPools, key)
+		slog.Info("Closed connection pool", "pool", key)
+	}
+	for key, db := range sqlDBs {
+		db.Close()
+		delete(sqlDBs, key)
+		slog.Info("Closed connection pool", "pool", key)
+	}
+}
+
+// A snapshot of one shared pool's connections, for /healthz and /metrics
+type poolStats struct {
+	// The pool's key, e.g. CLOUD_SQL_POSTGRES or CLOUD_SQL_MYSQL/read
+	Pool  string `json:"pool"`
+	Total int    `json:"total"`
+	Idle  int    `json:"idle"`
+	InUse int    `json:"in_use"`
+	// Times a request had to wait for a connection, and how long they waited in all, since the
+	// pool was created
+	WaitCount    int64         `json:"wait_count"`
+	WaitDuration time.Duration `json:"-"`
+	WaitMs       int64         `json:"wait_duration_ms"`
+}
+
+// Stats for every shared pool open, in order of their keys. Postgres pools count an acquire as a
+// wait when no idle connection was ready for it.
+func sharedPoolStats() []poolStats {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	var stats []poolStats
+	for key, p := range postgresPools {
+		s := p.pool.Stat()
+		stats = append(stats, poolStats{
+			Pool:         key,
+			Total:        int(s.TotalConns()),
+			Idle:         int(s.IdleConns()),
+			InUse:        int(s.AcquiredConns()),
+			WaitCount:    s.EmptyAcquireCount(),
+			WaitDuration: s.AcquireDuration(),
+		})
+	}
+	for key, db := range sqlDBs {
+		s := db.Stats()
+		stats = append(stats, poolStats{
+			Pool:         key,
+			Total:        s.OpenConnections,
+			Idle:         s.Idle,
+			InUse:        s.InUse,
+			WaitCount:    s.WaitCount,
+			WaitDuration: s.WaitDuration,
+		})
+	}
+	for i := range stats {
+		stats[i].WaitMs = stats[i].WaitDuration.Milliseconds()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Pool < stats[j].Pool })
+	return stats
+}
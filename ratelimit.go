@@ -0,0 +1,173 @@
+// Rate limiting for the endpoints that query the database, off unless RATE_LIMIT_RPS is set
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// How long a client's limiter is kept after its last request when limiting per IP
+	rateLimitIdle = 10 * time.Minute
+	// Clients tracked at once when limiting per IP, past which new clients share one bucket
+	rateLimitMaxClients = 10000
+)
+
+// A token bucket shared by every request, or one per client IP
+type rateLimiter struct {
+	RPS   rate.Limit
+	Burst int
+	PerIP bool
+	// Proxies in front of the app that append to X-Forwarded-For. 0 keys on the peer address.
+	TrustedProxies int
+	MaxClients     int
+
+	mu     sync.Mutex
+	global *rate.Limiter
+	// Per client IP, with when each was last used
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+	// Shared by the clients that arrive while the map is full
+	overflow *rate.Limiter
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Reads RATE_LIMIT_RPS, RATE_LIMIT_BURST, RATE_LIMIT_PER_IP and RATE_LIMIT_TRUSTED_PROXIES. Returns
+// nil when RATE_LIMIT_RPS is unset or 0. The burst defaults to the rate rounded up, so at least one
+// request gets through.
+func rateLimiterFromEnv() (*rateLimiter, error) {
+	v := os.Getenv("RATE_LIMIT_RPS")
+	if v == "" {
+		return nil, nil
+	}
+	rps, err := strconv.ParseFloat(v, 64)
+	if err != nil || rps < 0 || math.IsInf(rps, 0) || math.IsNaN(rps) {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_RPS %q (expecting a non-negative number of requests per second)", v)
+	}
+	if rps == 0 {
+		return nil, nil
+	}
+	burst := int(math.Ceil(rps))
+	if v := os.Getenv("RATE_LIMIT_BURST"); v != "" {
+		burst, err = strconv.Atoi(v)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_BURST %q (expecting a whole number of at least 1)", v)
+		}
+	}
+	proxies := 0
+	if v := os.Getenv("RATE_LIMIT_TRUSTED_PROXIES"); v != "" {
+		proxies, err = strconv.Atoi(v)
+		if err != nil || proxies < 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_TRUSTED_PROXIES %q (expecting a whole number)", v)
+		}
+	}
+	l := &rateLimiter{
+		RPS:            rate.Limit(rps),
+		Burst:          burst,
+		PerIP:          os.Getenv("RATE_LIMIT_PER_IP") == "true",
+		TrustedProxies: proxies,
+		MaxClients:     rateLimitMaxClients,
+	}
+	if l.PerIP {
+		l.clients = map[string]*clientLimiter{}
+		l.overflow = rate.NewLimiter(l.RPS, l.Burst)
+	} else {
+		l.global = rate.NewLimiter(l.RPS, l.Burst)
+	}
+	return l, nil
+}
+
+type peerAddrKey struct{}
+
+// Keeps the address the connection came from, before middleware.RealIP replaces RemoteAddr with
+// one the client can set in its headers
+func peerAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerAddrKey{}, r.RemoteAddr)))
+	})
+}
+
+// The client a request is limited as: the peer address, or with trusted proxies the
+// X-Forwarded-For entry added by the outermost of them. Entries to the left of it are the
+// client's own and aren't trusted.
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	addr, ok := r.Context().Value(peerAddrKey{}).(string)
+	if !ok {
+		addr = r.RemoteAddr
+	}
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+	if l.TrustedProxies == 0 {
+		return ip
+	}
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	if len(hops) < l.TrustedProxies {
+		// Didn't come through every proxy
+		return ip
+	}
+	return strings.TrimSpace(hops[len(hops)-l.TrustedProxies])
+}
+
+// The bucket for a request: the global one, or its client's
+func (l *rateLimiter) limiter(r *http.Request, now time.Time) *rate.Limiter {
+	if !l.PerIP {
+		return l.global
+	}
+	ip := l.clientIP(r)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Forget clients that have gone quiet, so the map doesn't grow without bound
+	if now.Sub(l.lastSweep) > rateLimitIdle {
+		for k, c := range l.clients {
+			if now.Sub(c.lastSeen) > rateLimitIdle {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	c, ok := l.clients[ip]
+	if !ok {
+		if len(l.clients) >= l.MaxClients {
+			return l.overflow
+		}
+		c = &clientLimiter{limiter: rate.NewLimiter(l.RPS, l.Burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = now
+	return c.limiter
+}
+
+// Answers requests over the limit with 429 and a Retry-After of the whole seconds until a token
+// is free, without passing them on
+func (l *rateLimiter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		res := l.limiter(r, now).ReserveN(now, 1)
+		if delay := res.DelayFrom(now); delay > 0 {
+			res.CancelAt(now)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeJSON(w, http.StatusTooManyRequests, v2Error{Error: "rate limit exceeded"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
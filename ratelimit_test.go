@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+func Test_RateLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		addrs []string
+		// X-Forwarded-For of each request, if any
+		xff []string
+		// Clients tracked before new ones share a bucket, if not the default
+		maxClients int
+		// Status of each request, sent back to back from the matching addr
+		want []int
+	}{
+		{
+			name:  "global burst",
+			env:   map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "2"},
+			addrs: []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"},
+			want:  []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:  "burst defaults to the rate",
+			env:   map[string]string{"RATE_LIMIT_RPS": "0.5"},
+			addrs: []string{"10.0.0.1:1", "10.0.0.1:1"},
+			want:  []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:  "per IP",
+			env:   map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_PER_IP": "true"},
+			addrs: []string{"10.0.0.1:1", "10.0.0.1:2", "10.0.0.2:1", "[::1]:1", "[::1]:2"},
+			want:  []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:  "per IP ignores a spoofed X-Forwarded-For",
+			env:   map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_PER_IP": "true"},
+			addrs: []string{"10.0.0.1:1", "10.0.0.1:1"},
+			xff:   []string{"192.0.2.1", "192.0.2.2"},
+			want:  []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:  "per IP behind a trusted proxy",
+			env:   map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_PER_IP": "true", "RATE_LIMIT_TRUSTED_PROXIES": "1"},
+			addrs: []string{"10.0.0.1:1", "10.0.0.1:1", "10.0.0.1:1", "10.0.0.1:1"},
+			xff:   []string{"192.0.2.1", "198.51.100.1", "203.0.113.9, 192.0.2.1", "198.51.100.2"},
+			want:  []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+		{
+			name:       "per IP shares a bucket past the client cap",
+			env:        map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_PER_IP": "true"},
+			maxClients: 1,
+			addrs:      []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"},
+			want:       []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"RATE_LIMIT_RPS", "RATE_LIMIT_BURST", "RATE_LIMIT_PER_IP", "RATE_LIMIT_TRUSTED_PROXIES"} {
+				t.Setenv(k, tt.env[k])
+			}
+			l, err := rateLimiterFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.maxClients > 0 {
+				l.MaxClients = tt.maxClients
+			}
+			var served int
+			// The same order as main, so RealIP has rewritten RemoteAddr by the time it's limited
+			h := peerAddr(middleware.RealIP(l.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ }))))
+			wantServed := 0
+			for i, addr := range tt.addrs {
+				req := httptest.NewRequest(http.MethodGet, "/data_driven_decaf/", nil)
+				req.RemoteAddr = addr
+				if i < len(tt.xff) {
+					req.Header.Set("X-Forwarded-For", tt.xff[i])
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code != tt.want[i] {
+					t.Fatalf("request %v from %v: status = %v, expected %v", i+1, addr, rec.Code, tt.want[i])
+				}
+				if rec.Code == http.StatusOK {
+					wantServed++
+					continue
+				}
+				if secs, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || secs < 1 {
+					t.Errorf("request %v: Retry-After = %q, expected whole seconds", i+1, rec.Header().Get("Retry-After"))
+				}
+			}
+			if served != wantServed {
+				t.Errorf("handler served %v requests, expected %v", served, wantServed)
+			}
+		})
+	}
+}
+
+func Test_RateLimiterFromEnv(t *testing.T) {
+	tests := []struct {
+		rps     string
+		burst   string
+		proxies string
+		wantOff bool
+		wantErr bool
+	}{
+		{rps: "", wantOff: true},
+		{rps: "0", wantOff: true},
+		{rps: "10", burst: "20"},
+		{rps: "fast", wantErr: true},
+		{rps: "-1", wantErr: true},
+		{rps: "NaN", wantErr: true},
+		{rps: "10", burst: "0", wantErr: true},
+		{rps: "10", burst: "1.5", wantErr: true},
+		{rps: "10", proxies: "2"},
+		{rps: "10", proxies: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("RATE_LIMIT_RPS", tt.rps)
+		t.Setenv("RATE_LIMIT_BURST", tt.burst)
+		t.Setenv("RATE_LIMIT_TRUSTED_PROXIES", tt.proxies)
+		l, err := rateLimiterFromEnv()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("rateLimiterFromEnv with RATE_LIMIT_RPS=%q RATE_LIMIT_BURST=%q error = %v, wantErr %v", tt.rps, tt.burst, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (l == nil) != tt.wantOff {
+			t.Errorf("rateLimiterFromEnv with RATE_LIMIT_RPS=%q = %+v, expected off %v", tt.rps, l, tt.wantOff)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Names of the coffee table and its columns, so the app can read an existing schema
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// The coffee table and its columns, from DB_TABLE, DB_ID_COLUMN, DB_BEAN_COLUMN and
+// DB_PRICE_COLUMN. The table may be qualified with its schema, e.g. staging.beans.
+type coffeeSchema struct {
+	Table string
+	ID    string
+	Bean  string
+	Price string
+	// The tables of a sharded catalog, from DB_TABLES in the order listed, read instead of Table.
+	// They all have the same columns.
+	Tables []string
+}
+
+var defaultCoffeeSchema = coffeeSchema{Table: "coffee", ID: "id", Bean: "bean", Price: "price"}
+
+// Names we are willing to put in SQL. They are quoted as well, but only accepting these
+// characters means a setting can never carry SQL of its own.
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// Env vars that name the coffee table and columns, with DB_TABLES last as it lists several tables
+var coffeeSchemaVars = []string{"DB_TABLE", "DB_ID_COLUMN", "DB_BEAN_COLUMN", "DB_PRICE_COLUMN", "DB_TABLES"}
+
+// Reads the coffee table and column names, defaulting to coffee (id, bean, price)
+func coffeeSchemaFromEnv() (coffeeSchema, error) {
+	s := defaultCoffeeSchema
+	names := []*string{&s.Table, &s.ID, &s.Bean, &s.Price}
+	for i, key := range coffeeSchemaVars[:len(names)] {
+		v := os.Getenv(key)
+		if v == "" {
+			continue
+		}
+		if err := checkSchemaName(key, v); err != nil {
+			return s, err
+		}
+		*names[i] = v
+	}
+	v := os.Getenv("DB_TABLES")
+	if v == "" {
+		return s, nil
+	}
+	if os.Getenv("DB_TABLE") != "" {
+		return s, fmt.Errorf("DB_TABLE and DB_TABLES can't both be set")
+	}
+	seen := map[string]bool{}
+	for _, table := range strings.Split(v, ",") {
+		table = strings.TrimSpace(table)
+		if err := checkSchemaName("DB_TABLES", table); err != nil {
+			return s, err
+		}
+		// Listing a table twice would count its rows twice
+		if seen[table] {
+			return s, fmt.Errorf("invalid DB_TABLES %q (%v is listed twice)", v, table)
+		}
+		seen[table] = true
+		s.Tables = append(s.Tables, table)
+	}
+	return s, nil
+}
+
+// Checks the value of key is a name we can put in SQL. Only tables may be qualified with a schema.
+func checkSchemaName(key, v string) error {
+	parts := strings.Split(v, ".")
+	if len(parts) > 2 || len(parts) == 2 && key != "DB_TABLE" && key != "DB_TABLES" {
+		return fmt.Errorf("invalid %v %q (too many dots)", key, v)
+	}
+	for _, p := range parts {
+		if !sqlIdentifier.MatchString(p) {
+			return fmt.Errorf("invalid %v %q (expecting letters, digits and underscores, not starting with a digit)", key, v)
+		}
+	}
+	return nil
+}
+
+// Whether any of the coffee table or column names are set
+func coffeeSchemaSet() bool {
+	for _, key := range coffeeSchemaVars {
+		if os.Getenv(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// The SQL dialects the coffee queries are written in
+type sqlDialect int
+
+const (
+	// MySQL, and SQLite, which accepts MySQL's backticks and LIMIT
+	dialectMySQL sqlDialect = iota
+	dialectPostgres
+	dialectSQLServer
+)
+
+// Quotes a name, and each part of a schema-qualified one: with double quotes for Postgres,
+// brackets for SQL Server and backticks for MySQL, which SQLite accepts too. Quoted names are case
+// sensitive on Postgres.
+func quoteIdentifier(name string, d sqlDialect) string {
+	open, close := "`", "`"
+	switch d {
+	case dialectPostgres:
+		open, close = `"`, `"`
+	case dialectSQLServer:
+		open, close = "[", "]"
+	}
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = open + p + close
+	}
+	return strings.Join(parts, ".")
+}
+
+// The names quoted for the dialect, ready to go in SQL
+func (s coffeeSchema) quoted(d sqlDialect) coffeeSchema {
+	return coffeeSchema{
+		Table:  quoteIdentifier(s.Table, d),
+		ID:     quoteIdentifier(s.ID, d),
+		Bean:   quoteIdentifier(s.Bean, d),
+		Price:  quoteIdentifier(s.Price, d),
+		Tables: quoteIdentifiers(s.Tables, d),
+	}
+}
+
+func quoteIdentifiers(names []string, d sqlDialect) []string {
+	if names == nil {
+		return nil
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdentifier(name, d)
+	}
+	return quoted
+}
+
+// What the rows are read from: the table, or with DB_TABLES a union of every table, each row
+// numbered with its table's position in the list as coffee_shard. Call it on quoted names.
+func (s coffeeSchema) source() string {
+	if len(s.Tables) == 0 {
+		return s.Table
+	}
+	selects := make([]string, len(s.Tables))
+	for i, table := range s.Tables {
+		selects[i] = fmt.Sprintf("select %d as coffee_shard, %v, %v, %v from %v", i, s.ID, s.Bean, s.Price, table)
+	}
+	return "(" + strings.Join(selects, " union all ") + ") as coffee_shards"
+}
+
+// The ORDER BY that fixes where the magic index lands across DB_TABLES: the tables in the order
+// listed, and each table's rows by id. A single table is read in its natural order, so this is
+// empty without DB_TABLES. Call it on quoted names.
+func (s coffeeSchema) order() string {
+	if len(s.Tables) == 0 {
+		return ""
+	}
+	return " order by coffee_shard, " + s.ID
+}
+
+// The quoted coffee table and column names for the dialect
+func quotedCoffeeSchema(d sqlDialect) (coffeeSchema, error) {
+	s, err := coffeeSchemaFromEnv()
+	if err != nil {
+		return s, err
+	}
+	return s.quoted(d), nil
+}
+
+// The quoted coffee schema new coffees are added to. There's no telling which of DB_TABLES a
+// coffee belongs in, so adding one fails when it's set.
+func coffeeInsertSchema(d sqlDialect) (coffeeSchema, error) {
+	s, err := quotedCoffeeSchema(d)
+	if err == nil && len(s.Tables) > 0 {
+		err = fmt.Errorf("coffees can't be added with DB_TABLES set, set DB_TABLE to the table to add them to")
+	}
+	return s, err
+}
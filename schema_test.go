@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func Test_CoffeeSchema(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantPostgres string
+		wantMySQL    string
+		// The SQL Server query, where it differs from the others only in quoting
+		wantSQLServer string
+		wantErr       bool
+	}{
+		{
+			name:          "default",
+			wantPostgres:  `select "id", "bean", "price" from "coffee"`,
+			wantMySQL:     "select `id`, `bean`, `price` from `coffee`",
+			wantSQLServer: "select [id], [bean], [price] from [coffee]",
+		},
+		{
+			name:          "custom",
+			env:           map[string]string{"DB_TABLE": "staging.beans", "DB_BEAN_COLUMN": "name", "DB_PRICE_COLUMN": "Cost"},
+			wantPostgres:  `select "id", "name", "Cost" from "staging"."beans"`,
+			wantMySQL:     "select `id`, `name`, `Cost` from `staging`.`beans`",
+			wantSQLServer: "select [id], [name], [Cost] from [staging].[beans]",
+		},
+		{
+			name:          "sharded",
+			env:           map[string]string{"DB_TABLES": "coffee_us, staging.coffee_eu"},
+			wantPostgres:  `select "id", "bean", "price" from (select 0 as coffee_shard, "id", "bean", "price" from "coffee_us" union all select 1 as coffee_shard, "id", "bean", "price" from "staging"."coffee_eu") as coffee_shards order by coffee_shard, "id"`,
+			wantMySQL:     "select `id`, `bean`, `price` from (select 0 as coffee_shard, `id`, `bean`, `price` from `coffee_us` union all select 1 as coffee_shard, `id`, `bean`, `price` from `staging`.`coffee_eu`) as coffee_shards order by coffee_shard, `id`",
+			wantSQLServer: "select [id], [bean], [price] from (select 0 as coffee_shard, [id], [bean], [price] from [coffee_us] union all select 1 as coffee_shard, [id], [bean], [price] from [staging].[coffee_eu]) as coffee_shards order by coffee_shard, [id]",
+		},
+		{name: "injected table", env: map[string]string{"DB_TABLE": "coffee; drop table coffee"}, wantErr: true},
+		{name: "injected quote", env: map[string]string{"DB_BEAN_COLUMN": `bean" from coffee --`}, wantErr: true},
+		{name: "injected backtick", env: map[string]string{"DB_PRICE_COLUMN": "price`"}, wantErr: true},
+		{name: "injected bracket", env: map[string]string{"DB_TABLE": "coffee]; drop table [coffee"}, wantErr: true},
+		{name: "leading digit", env: map[string]string{"DB_TABLE": "1coffee"}, wantErr: true},
+		{name: "qualified column", env: map[string]string{"DB_ID_COLUMN": "coffee.id"}, wantErr: true},
+		{name: "too many dots", env: map[string]string{"DB_TABLE": "db.staging.beans"}, wantErr: true},
+		{name: "empty schema", env: map[string]string{"DB_TABLE": ".beans"}, wantErr: true},
+		{name: "with QUERY", env: map[string]string{"QUERY": "select id, bean, price from coffee", "DB_TABLE": "beans"}, wantErr: true},
+		{name: "injected shard", env: map[string]string{"DB_TABLES": "coffee_us,coffee_eu; drop table coffee"}, wantErr: true},
+		{name: "blank shard", env: map[string]string{"DB_TABLES": "coffee_us,,coffee_eu"}, wantErr: true},
+		{name: "shard listed twice", env: map[string]string{"DB_TABLES": "coffee_us,coffee_eu,coffee_us"}, wantErr: true},
+		{name: "DB_TABLES with DB_TABLE", env: map[string]string{"DB_TABLES": "coffee_us,coffee_eu", "DB_TABLE": "coffee"}, wantErr: true},
+		{name: "DB_TABLES with QUERY", env: map[string]string{"QUERY": "select id, bean, price from coffee", "DB_TABLES": "coffee_us"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range append([]string{"QUERY"}, coffeeSchemaVars...) {
+				t.Setenv(k, "")
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			postgres, err := coffeeQuery(dialectPostgres)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("coffeeQuery error = %v, wantErr %v", err, tt.wantErr)
+			}
+			mysql, _ := coffeeQuery(dialectMySQL)
+			if postgres != tt.wantPostgres || mysql != tt.wantMySQL {
+				t.Errorf("coffeeQuery = %q and %q, expected %q and %q", postgres, mysql, tt.wantPostgres, tt.wantMySQL)
+			}
+			if sqlServer, _ := coffeeQuery(dialectSQLServer); sqlServer != tt.wantSQLServer {
+				t.Errorf("coffeeQuery(dialectSQLServer) = %q, expected %q", sqlServer, tt.wantSQLServer)
+			}
+		})
+	}
+}
+
+func Test_CoffeeSchemaSQLite(t *testing.T) {
+	// The columns are named differently and stored in another order
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "coffee.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("create table beans (cost text, name text, bean_id integer primary key)"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 60; i++ {
+		if _, err := db.Exec("insert into beans values (?, ?, ?)", "2.50", fmt.Sprintf("Bean-%d", i), i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("DB_TABLE", "beans")
+	t.Setenv("DB_ID_COLUMN", "bean_id")
+	t.Setenv("DB_BEAN_COLUMN", "name")
+	t.Setenv("DB_PRICE_COLUMN", "cost")
+
+	for _, aggregate := range []string{"false", "true"} {
+		t.Run("SQL_AGGREGATE="+aggregate, func(t *testing.T) {
+			t.Setenv("SQL_AGGREGATE", aggregate)
+			result, err := DDDMySQLRows(context.Background(), db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.MagicCoffee != "Bean-50" || result.TotalCents != 15000 || result.RowCount != 60 {
+				t.Errorf("DDDMySQLRows = %+v, expected Bean-50, 15000 cents and 60 rows", result)
+			}
+		})
+	}
+
+	c, err := insertCoffeeSQL(context.Background(), db, Coffee{Bean: "Arabica", Price: parsePrice("3.50")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != 61 {
+		t.Errorf("insertCoffeeSQL id = %v, expected 61", c.ID)
+	}
+}
+
+func Test_CoffeeTablesSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "coffee.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// 30 US rows at 2.00 and 40 EU rows at 3.00, each table's rows inserted in reverse id order
+	for table, n := range map[string]int{"coffee_us": 30, "coffee_eu": 40} {
+		if _, err := db.Exec(fmt.Sprintf("create table %v (id integer, bean text, price text)", table)); err != nil {
+			t.Fatal(err)
+		}
+		price := map[string]string{"coffee_us": "2.00", "coffee_eu": "3.00"}[table]
+		for id := n; id > 0; id-- {
+			if _, err := db.Exec(fmt.Sprintf("insert into %v values (?, ?, ?)", table), id, fmt.Sprintf("%v-%d", table, id), price); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		tables string
+		// The magic index 50 counts the first table's rows first, each table by id
+		wantMagic string
+	}{
+		{tables: "coffee_us,coffee_eu", wantMagic: "coffee_eu-21"},
+		{tables: "coffee_eu,coffee_us", wantMagic: "coffee_us-11"},
+	}
+	for _, tt := range tests {
+		for _, aggregate := range []string{"false", "true"} {
+			t.Run(tt.tables+"/SQL_AGGREGATE="+aggregate, func(t *testing.T) {
+				t.Setenv("DB_TABLES", tt.tables)
+				t.Setenv("SQL_AGGREGATE", aggregate)
+				for i := 0; i < 3; i++ {
+					result, err := DDDMySQLRows(context.Background(), db)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if result.MagicCoffee != tt.wantMagic || result.TotalCents != 18000 || result.Total != 180 || result.RowCount != 70 {
+						t.Errorf("DDDMySQLRows = %+v, expected %v, 18000 cents and 70 rows", result, tt.wantMagic)
+					}
+				}
+			})
+		}
+	}
+
+	t.Setenv("DB_TABLES", "coffee_us,coffee_eu")
+	if _, err := insertCoffeeSQL(context.Background(), db, Coffee{Bean: "Arabica", Price: parsePrice("3.50")}); err == nil {
+		t.Error("insertCoffeeSQL with DB_TABLES succeeded, expected an error")
+	}
+}
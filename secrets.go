@@ -0,0 +1,83 @@
+// Resolves configuration stored in Google Secret Manager
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"golang.org/x/exp/slog"
+)
+
+// Prefix marking an environment variable whose value is a Secret Manager secret version
+const secretPrefix = "sm://"
+
+// Variables that may hold a Secret Manager reference instead of a value
+var secretEnvVars = []string{"DB_USER", "DB_PASS", "BOND_SERVICE_URL"}
+
+var secretVersionName = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+/versions/[^/]+$`)
+
+var (
+	secretsMu sync.Mutex
+	// Secret version name -> value, so each version is only fetched once
+	secretCache = map[string]string{}
+)
+
+// Fetches a secret version's value (swapped out in tests)
+var accessSecret = func(ctx context.Context, name string) (string, error) {
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	res, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: name})
+	if err != nil {
+		return "", err
+	}
+	return string(res.Payload.Data), nil
+}
+
+// Returns value, or the secret it refers to if it is an sm://projects/.../secrets/.../versions/... reference
+func resolveSecret(ctx context.Context, value string) (string, error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return value, nil
+	}
+	name := strings.TrimPrefix(value, secretPrefix)
+	if !secretVersionName.MatchString(name) {
+		return "", fmt.Errorf("invalid secret reference %v (expecting sm://projects/PROJECT/secrets/SECRET/versions/VERSION)", value)
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if v, ok := secretCache[name]; ok {
+		return v, nil
+	}
+	v, err := accessSecret(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("could not access secret %v: %w", name, err)
+	}
+	secretCache[name] = v
+	return v, nil
+}
+
+// Replaces Secret Manager references in DB_USER, DB_PASS and BOND_SERVICE_URL with the secrets
+// themselves, stopping the app if one can't be resolved
+func resolveSecrets(ctx context.Context) {
+	for _, key := range secretEnvVars {
+		value := os.Getenv(key)
+		if !strings.HasPrefix(value, secretPrefix) {
+			continue
+		}
+		resolved, err := resolveSecret(ctx, value)
+		if err != nil {
+			log.Fatalf("Cannot resolve %v from Secret Manager: %v\n", key, err)
+		}
+		os.Setenv(key, resolved)
+		slog.Info("Resolved from Secret Manager", "variable", key)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func Test_ResolveSecret(t *testing.T) {
+	var accessed int
+	orig := accessSecret
+	accessSecret = func(ctx context.Context, name string) (string, error) {
+		accessed++
+		if name == "projects/p/secrets/missing/versions/1" {
+			return "", errors.New("NotFound")
+		}
+		return "value-of-" + name, nil
+	}
+	t.Cleanup(func() { accessSecret = orig })
+
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "plain", want: "plain"},
+		{value: "sm://projects/p/secrets/db-pass/versions/latest", want: "value-of-projects/p/secrets/db-pass/versions/latest"},
+		{value: "sm://projects/p/secrets/db-pass/versions/latest", want: "value-of-projects/p/secrets/db-pass/versions/latest"},
+		{value: "sm://projects/p/secrets/missing/versions/1", wantErr: true},
+		{value: "sm://db-pass", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := resolveSecret(context.Background(), tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveSecret(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolveSecret(%q) = %q, expected %q", tt.value, got, tt.want)
+		}
+	}
+	// The repeated reference comes from the cache and the invalid one is never fetched
+	if accessed != 2 {
+		t.Errorf("accessed Secret Manager %d times, expected 2", accessed)
+	}
+}
@@ -0,0 +1,303 @@
+// Seeds the coffee table from a CSV or JSON file, e.g. to load test the aggregation
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// Empty the table before inserting
+	seedModeTruncate = "truncate"
+	// Insert new rows and overwrite existing ones with the same id
+	seedModeUpsert = "upsert"
+
+	defaultSeedBatchSize = 500
+)
+
+type seedRow struct {
+	ID    int    `json:"id"`
+	Bean  string `json:"bean"`
+	Price string `json:"price"`
+}
+
+// Streams rows from a seed file, returning io.EOF after the last one
+type seedReader interface {
+	Next() (seedRow, error)
+}
+
+// Reads id,bean,price records, skipping an optional header line
+type csvSeedReader struct {
+	r    *csv.Reader
+	line int
+}
+
+func newCSVSeedReader(r io.Reader) *csvSeedReader {
+	c := csv.NewReader(r)
+	c.FieldsPerRecord = 3
+	c.TrimLeadingSpace = true
+	return &csvSeedReader{r: c}
+}
+
+func (s *csvSeedReader) Next() (row seedRow, err error) {
+	record, err := s.r.Read()
+	if err != nil {
+		return row, err
+	}
+	s.line++
+	if s.line == 1 && strings.EqualFold(record[0], "id") {
+		return s.Next()
+	}
+	row.ID, err = strconv.Atoi(record[0])
+	if err != nil {
+		return row, fmt.Errorf("line %v: invalid id %q", s.line, record[0])
+	}
+	row.Bean = record[1]
+	row.Price = record[2]
+	return row, nil
+}
+
+// Reads a JSON array of {"id":..,"bean":..,"price":..} objects one element at a time
+type jsonSeedReader struct {
+	d       *json.Decoder
+	started bool
+}
+
+func newJSONSeedReader(r io.Reader) *jsonSeedReader {
+	return &jsonSeedReader{d: json.NewDecoder(r)}
+}
+
+func (s *jsonSeedReader) Next() (row seedRow, err error) {
+	if !s.started {
+		t, err := s.d.Token()
+		if err != nil {
+			return row, err
+		}
+		if t != json.Delim('[') {
+			return row, fmt.Errorf("expected a JSON array of coffee rows")
+		}
+		s.started = true
+	}
+	if !s.d.More() {
+		return row, io.EOF
+	}
+	err = s.d.Decode(&row)
+	return row, err
+}
+
+// Adapts a seedReader to pgx's COPY, which streams every row in a single statement
+type seedCopySource struct {
+	rows seedReader
+	row  seedRow
+	err  error
+}
+
+func (s *seedCopySource) Next() bool {
+	s.row, s.err = s.rows.Next()
+	return s.err == nil
+}
+
+func (s *seedCopySource) Values() ([]interface{}, error) {
+	return []interface{}{s.row.ID, s.row.Bean, s.row.Price}, nil
+}
+
+func (s *seedCopySource) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+// Seeds the database from SEED_FILE if it is set, stopping the app if seeding fails.
+// SEED_MODE is truncate (default) or upsert, SEED_BATCH_SIZE sets the rows per MySQL insert.
+func seedFromFile(ctx context.Context) {
+	path := os.Getenv("SEED_FILE")
+	if path == "" {
+		return
+	}
+	mode := os.Getenv("SEED_MODE")
+	if mode == "" {
+		mode = seedModeTruncate
+	}
+	if mode != seedModeTruncate && mode != seedModeUpsert {
+		log.Fatalf("Seeding: Error: invalid SEED_MODE %v (expecting truncate or upsert)\n", mode)
+	}
+	batchSize := defaultSeedBatchSize
+	if v := os.Getenv("SEED_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("Seeding: Error: invalid SEED_BATCH_SIZE %v\n", v)
+		}
+		batchSize = n
+	}
+
+	slog.Info("Seeding: Loading", "path", path, "mode", mode)
+	n, err := seedCoffee(ctx, os.Getenv("DB_TYPE"), path, mode, batchSize)
+	if err != nil {
+		log.Fatalf("Seeding: Error: %v\n", err)
+	}
+	slog.Info("Seeding: Inserted rows", "rows", n, "path", path)
+}
+
+// Streams the rows in the file at path into the coffee table in a single transaction
+func seedCoffee(ctx context.Context, engine string, path string, mode string, batchSize int) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var rows seedReader
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		rows = newCSVSeedReader(f)
+	case ".json":
+		rows = newJSONSeedReader(f)
+	default:
+		return 0, fmt.Errorf("unsupported seed file %v (expecting .csv or .json)", path)
+	}
+
+	switch engine {
+	case "ALLOY_DB", "CLOUD_SQL_POSTGRES":
+		pool, err := sharedPostgresPool(ctx, engine)
+		if err != nil {
+			return 0, err
+		}
+		return seedPostgres(ctx, pool, rows, mode)
+	case "CLOUD_SQL_MYSQL":
+		db, err := sharedSQLDB(ctx, "CLOUD_SQL_MYSQL")
+		if err != nil {
+			return 0, err
+		}
+		return seedMySQL(ctx, db, rows, mode, batchSize)
+	default:
+		return 0, fmt.Errorf("%w %v", ErrUnknownDBType, engine)
+	}
+}
+
+// The coffee table and columns to seed, as named by DB_TABLE and DB_*_COLUMN. There's no telling
+// which of DB_TABLES a row belongs in, so seeding fails when it's set.
+func seedSchema() (coffeeSchema, error) {
+	s, err := coffeeSchemaFromEnv()
+	if err == nil && len(s.Tables) > 0 {
+		err = fmt.Errorf("SEED_FILE can't be loaded with DB_TABLES set, set DB_TABLE to the table to seed")
+	}
+	return s, err
+}
+
+// Seeds Postgres with COPY. Upserts COPY into a temporary table first, as COPY itself cannot upsert.
+func seedPostgres(ctx context.Context, pool *pgxpool.Pool, rows seedReader, mode string) (int64, error) {
+	schema, err := seedSchema()
+	if err != nil {
+		return 0, err
+	}
+	q := schema.quoted(dialectPostgres)
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	target := pgx.Identifier(strings.Split(schema.Table, "."))
+	if mode == seedModeTruncate {
+		_, err = tx.Exec(ctx, "truncate table "+q.Table)
+	} else {
+		target = pgx.Identifier{"coffee_seed"}
+		_, err = tx.Exec(ctx, "create temporary table coffee_seed (like "+q.Table+" including defaults) on commit drop")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := tx.CopyFrom(ctx, target, []string{schema.ID, schema.Bean, schema.Price}, &seedCopySource{rows: rows})
+	if err != nil {
+		return 0, err
+	}
+	if mode == seedModeUpsert {
+		_, err = tx.Exec(ctx, fmt.Sprintf("insert into %[1]v (%[2]v, %[3]v, %[4]v) select %[2]v, %[3]v, %[4]v from coffee_seed "+
+			"on conflict (%[2]v) do update set %[3]v = excluded.%[3]v, %[4]v = excluded.%[4]v", q.Table, q.ID, q.Bean, q.Price))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit(ctx)
+}
+
+// Seeds MySQL with multi-row inserts of batchSize rows
+func seedMySQL(ctx context.Context, db *sql.DB, rows seedReader, mode string, batchSize int) (int64, error) {
+	schema, err := seedSchema()
+	if err != nil {
+		return 0, err
+	}
+	q := schema.quoted(dialectMySQL)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// TRUNCATE would implicitly commit, so empty the table with DELETE to keep it in the transaction
+	if mode == seedModeTruncate {
+		if _, err := tx.ExecContext(ctx, "delete from "+q.Table); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int64
+	batch := make([]seedRow, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		query := fmt.Sprintf("insert into %v (%v, %v, %v) values ", q.Table, q.ID, q.Bean, q.Price) +
+			strings.TrimSuffix(strings.Repeat("(?, ?, ?), ", len(batch)), ", ")
+		if mode == seedModeUpsert {
+			query += fmt.Sprintf(" on duplicate key update %[1]v = values(%[1]v), %[2]v = values(%[2]v)", q.Bean, q.Price)
+		}
+		args := make([]interface{}, 0, len(batch)*3)
+		for _, row := range batch {
+			args = append(args, row.ID, row.Bean, row.Price)
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+		n += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		batch = append(batch, row)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
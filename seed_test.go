@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Reads every row from a seed reader
+func readSeedRows(r seedReader) (rows []seedRow, err error) {
+	for {
+		row, err := r.Next()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+func Test_SeedReaders(t *testing.T) {
+	want := []seedRow{{ID: 1, Bean: "Arabica", Price: "3.50"}, {ID: 2, Bean: "Robusta", Price: "10.99"}}
+
+	tests := []struct {
+		name    string
+		reader  seedReader
+		wantErr bool
+	}{
+		{
+			name:   "csv with header",
+			reader: newCSVSeedReader(strings.NewReader("id,bean,price\n1,Arabica,3.50\n2,Robusta,10.99\n")),
+		},
+		{
+			name:   "csv without header",
+			reader: newCSVSeedReader(strings.NewReader("1,Arabica,3.50\n2,Robusta,10.99\n")),
+		},
+		{
+			name:   "json",
+			reader: newJSONSeedReader(strings.NewReader(`[{"id":1,"bean":"Arabica","price":"3.50"},{"id":2,"bean":"Robusta","price":"10.99"}]`)),
+		},
+		{
+			name:    "csv with bad id",
+			reader:  newCSVSeedReader(strings.NewReader("one,Arabica,3.50\n")),
+			wantErr: true,
+		},
+		{
+			name:    "json object",
+			reader:  newJSONSeedReader(strings.NewReader(`{"id":1}`)),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readSeedRows(tt.reader)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("seed reader error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(want) {
+				t.Fatalf("seed reader returned %d rows, expected %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("row %d = %+v, expected %+v", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_SeedMySQLBatches(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("delete from `coffee`").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("insert into `coffee` (`id`, `bean`, `price`) values (?, ?, ?), (?, ?, ?)")+"$").
+		WithArgs(1, "a", "1.00", 2, "b", "2.00").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("insert into `coffee` (`id`, `bean`, `price`) values (?, ?, ?)")+"$").
+		WithArgs(3, "c", "3.00").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rows := newCSVSeedReader(strings.NewReader("1,a,1.00\n2,b,2.00\n3,c,3.00\n"))
+	n, err := seedMySQL(context.Background(), db, rows, seedModeTruncate, 2)
+	if err != nil {
+		t.Fatalf("seedMySQL error = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("seedMySQL inserted %d rows, expected 3", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_SeedMySQLSchema(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		mode       string
+		wantDelete string
+		wantInsert string
+		wantErr    bool
+	}{
+		{
+			name:       "truncate",
+			env:        map[string]string{"DB_TABLE": "staging.beans", "DB_ID_COLUMN": "bean_id", "DB_BEAN_COLUMN": "name", "DB_PRICE_COLUMN": "cost"},
+			mode:       seedModeTruncate,
+			wantDelete: "delete from `staging`.`beans`",
+			wantInsert: "insert into `staging`.`beans` (`bean_id`, `name`, `cost`) values (?, ?, ?)",
+		},
+		{
+			name: "upsert",
+			env:  map[string]string{"DB_TABLE": "beans", "DB_BEAN_COLUMN": "name", "DB_PRICE_COLUMN": "cost"},
+			mode: seedModeUpsert,
+			wantInsert: "insert into `beans` (`id`, `name`, `cost`) values (?, ?, ?) " +
+				"on duplicate key update `name` = values(`name`), `cost` = values(`cost`)",
+		},
+		{
+			// The service reads every table, but a row could go in any of them
+			name:    "sharded",
+			env:     map[string]string{"DB_TABLES": "beans_eu,beans_us"},
+			mode:    seedModeTruncate,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if !tt.wantErr {
+				mock.ExpectBegin()
+				if tt.wantDelete != "" {
+					mock.ExpectExec(regexp.QuoteMeta(tt.wantDelete)).WillReturnResult(sqlmock.NewResult(0, 0))
+				}
+				mock.ExpectExec(regexp.QuoteMeta(tt.wantInsert)+"$").WithArgs(1, "a", "1.00").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+
+			_, err = seedMySQL(context.Background(), db, newCSVSeedReader(strings.NewReader("1,a,1.00\n")), tt.mode, 10)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("seedMySQL error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
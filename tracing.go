@@ -0,0 +1,97 @@
+// OpenTelemetry tracing of Data-Driven Decaf, off unless an OTLP endpoint is configured
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Service name on exported spans unless OTEL_SERVICE_NAME is set
+const defaultServiceName = "cymbal-coffee-backend"
+
+// Spans come from whichever provider is set globally, a no-op one until initTracing sets a real one.
+// Looked up each time, as a tracer kept from before otel.SetTracerProvider sticks to the first provider.
+func tracer() trace.Tracer {
+	return otel.Tracer("backend")
+}
+
+// Exports spans over OTLP/gRPC when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set, unless OTEL_SDK_DISABLED is true. The exporter reads
+// the rest of the standard OTEL_EXPORTER_OTLP_* variables itself, such as headers and TLS.
+// Returns a function that flushes and stops the exporter, to call before exiting.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") ||
+		(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "") {
+		return func(context.Context) error { return nil }, nil
+	}
+	exp, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// resource.Default reads OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES, and without them names
+	// the service after the binary
+	res := resource.Default()
+	if os.Getenv("OTEL_SERVICE_NAME") == "" {
+		res, err = resource.Merge(res, resource.NewSchemaless(semconv.ServiceNameKey.String(defaultServiceName)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	setTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Makes tp the source of spans and has incoming and outgoing requests carry W3C Trace Context
+func setTracerProvider(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// The db.system of each engine's spans
+var dbSystems = map[string]attribute.KeyValue{
+	"ALLOY_DB":            semconv.DBSystemPostgreSQL,
+	"CLOUD_SQL_POSTGRES":  semconv.DBSystemPostgreSQL,
+	"CLOUD_SQL_MYSQL":     semconv.DBSystemMySQL,
+	"CLOUD_SQL_SQLSERVER": semconv.DBSystemMSSQL,
+	"SQLITE":              semconv.DBSystemSqlite,
+}
+
+// Starts the span around reading the coffee rows from engine
+func startQuerySpan(ctx context.Context, engine string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "query coffee", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(dbSystems[engine]))
+}
+
+// Starts the server span for r, as a child of the caller's span if it sent a traceparent
+func startRequestSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(r.Method), semconv.HTTPTargetKey.String(r.URL.RequestURI())))
+}
+
+// Marks span failed with err
+func spanFailed(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Ends span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		spanFailed(span, err)
+	}
+	span.End()
+}
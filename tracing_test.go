@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Records spans in memory as they end, for the rest of the test
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exp := tracetest.NewInMemoryExporter()
+	setTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+	return exp
+}
+
+func Test_DDDHandlerSpans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coffee.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("create table coffee (id integer primary key, bean text, price text)"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 60; i++ {
+		if _, err := db.Exec("insert into coffee values (?, ?, ?)", i+1, fmt.Sprintf("Bean-%d", i), "2.50"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	useDBType(t, "SQLITE")
+	t.Setenv("DB_PATH", path)
+	t.Cleanup(closePools)
+
+	tests := []struct {
+		name       string
+		bondStatus int
+		wantStatus codes.Code
+	}{
+		{name: "verified", bondStatus: http.StatusOK, wantStatus: codes.Unset},
+		{name: "bond fails", bondStatus: http.StatusBadRequest, wantStatus: codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exp := recordSpans(t)
+			var bondTraceparent string
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				bondTraceparent = r.Header.Get("traceparent")
+				w.WriteHeader(tt.bondStatus)
+			})
+			// The caller's span, which ours should continue
+			const callerTrace, callerSpan = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+			req := httptest.NewRequest(http.MethodGet, "/data_driven_decaf/", nil)
+			req.Header.Set("traceparent", "00-"+callerTrace+"-"+callerSpan+"-01")
+			dddHandler(httptest.NewRecorder(), req)
+
+			spans := map[string]tracetest.SpanStub{}
+			for _, s := range exp.GetSpans() {
+				spans[s.Name] = s
+			}
+			handler, ok := spans["data_driven_decaf"]
+			if !ok {
+				t.Fatalf("spans = %v, expected data_driven_decaf", exp.GetSpans())
+			}
+			if handler.SpanContext.TraceID().String() != callerTrace || handler.Parent.SpanID().String() != callerSpan {
+				t.Errorf("handler span parent = %v/%v, expected the caller's %v/%v", handler.SpanContext.TraceID(), handler.Parent.SpanID(), callerTrace, callerSpan)
+			}
+			if handler.Status.Code != tt.wantStatus {
+				t.Errorf("handler span status = %v, expected %v", handler.Status.Code, tt.wantStatus)
+			}
+			for name, want := range map[string]attribute.KeyValue{
+				"query coffee":                 semconv.DBSystemSqlite,
+				"bond " + defaultDDDVerifyPath: semconv.HTTPStatusCodeKey.Int(tt.bondStatus),
+			} {
+				s, ok := spans[name]
+				if !ok {
+					t.Errorf("no %v span", name)
+					continue
+				}
+				if s.Parent.SpanID() != handler.SpanContext.SpanID() {
+					t.Errorf("%v span parent = %v, expected the handler span %v", name, s.Parent.SpanID(), handler.SpanContext.SpanID())
+				}
+				var found bool
+				for _, kv := range s.Attributes {
+					found = found || kv == want
+				}
+				if !found {
+					t.Errorf("%v span attributes = %v, expected %v", name, s.Attributes, want)
+				}
+			}
+			bond := spans["bond "+defaultDDDVerifyPath]
+			if want := fmt.Sprintf("00-%v-%v-01", callerTrace, bond.SpanContext.SpanID()); bondTraceparent != want {
+				t.Errorf("Bond got traceparent %q, expected %q", bondTraceparent, want)
+			}
+			if bond.Status.Code != tt.wantStatus {
+				t.Errorf("bond span status = %v, expected %v", bond.Status.Code, tt.wantStatus)
+			}
+		})
+	}
+}
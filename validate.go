@@ -0,0 +1,85 @@
+// Checks the configuration works without serving traffic, see --validate
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// How long --validate may spend on each of the database and Bond checks
+const validateTimeout = 30 * time.Second
+
+// Runs SELECT 1 through the DB type's shared pool, creating the pool if needed
+func selectOne(ctx context.Context, engine string) error {
+	var one int
+	switch engine {
+	case "ALLOY_DB", "CLOUD_SQL_POSTGRES":
+		pool, err := sharedPostgresPool(ctx, engine)
+		if err != nil {
+			return err
+		}
+		return pool.QueryRow(ctx, "select 1").Scan(&one)
+	case "CLOUD_SQL_MYSQL", "CLOUD_SQL_SQLSERVER", "SQLITE":
+		db, err := sharedSQLDB(ctx, engine)
+		if err != nil {
+			return err
+		}
+		return db.QueryRowContext(ctx, "select 1").Scan(&one)
+	case "FAKE":
+		return nil
+	default:
+		return fmt.Errorf("%w %v", ErrUnknownDBType, engine)
+	}
+}
+
+// Checks Bond answers at all. Any HTTP response will do, as Bond has no endpoint for this and
+// a 404 still shows the URL, TLS settings and network path work.
+func checkBondReachable(ctx context.Context) (status int, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bondCfg.BondURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := bondCfg.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	return res.StatusCode, nil
+}
+
+// Checks the database settings, connects and runs SELECT 1, then checks Bond can be reached
+// unless SKIP_BOND is set. The error says which step failed.
+func validateConfig(ctx context.Context) error {
+	engine := os.Getenv("DB_TYPE")
+	if engine != "SQLITE" && engine != "FAKE" {
+		if _, err := dbConnectionInfo(); err != nil {
+			return fmt.Errorf("database configuration: %w", err)
+		}
+	}
+	dbCtx, cancel := context.WithTimeout(ctx, validateTimeout)
+	defer cancel()
+	if err := selectOne(dbCtx, engine); err != nil {
+		return fmt.Errorf("could not query %v: %w", engine, err)
+	}
+	slog.Info("Validate: Database reachable", "db_type", engine)
+	if skipBond() {
+		slog.Info("Validate: Bond check skipped, SKIP_BOND is set")
+		return nil
+	}
+
+	bondCtx, cancel := context.WithTimeout(ctx, validateTimeout)
+	defer cancel()
+	status, err := checkBondReachable(bondCtx)
+	if err != nil {
+		return fmt.Errorf("could not reach Bond at %v: %w", bondCfg.BondURL, err)
+	}
+	slog.Info("Validate: Bond reachable", "bond_url", bondCfg.BondURL, "status", status)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_ValidateConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coffee.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("create table coffee (id integer primary key, bean text, price text)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// Bond has nothing at its root, which still counts as reachable
+	stubBond(t, func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) })
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		bondURL string
+		wantErr string
+	}{
+		{name: "valid", env: map[string]string{"DB_TYPE": "SQLITE", "DB_PATH": path}},
+		{name: "missing database file", env: map[string]string{"DB_TYPE": "SQLITE", "DB_PATH": filepath.Join(t.TempDir(), "missing.db")}, wantErr: "could not query SQLITE"},
+		{name: "missing settings", env: map[string]string{"DB_TYPE": "CLOUD_SQL_POSTGRES", "DB_USER": "decaf"}, wantErr: "database configuration"},
+		{name: "bond unreachable", env: map[string]string{"DB_TYPE": "SQLITE", "DB_PATH": path}, bondURL: down.URL, wantErr: "could not reach Bond"},
+		{name: "bond skipped", env: map[string]string{"DB_TYPE": "SQLITE", "DB_PATH": path, "SKIP_BOND": "true"}, bondURL: down.URL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"DB_USER", "DB_PASS", "DB_NAME", "DB_INSTANCE", "DB_IAM_AUTH"} {
+				t.Setenv(k, "")
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if tt.bondURL != "" {
+				orig := bondCfg.BondURL
+				bondCfg.BondURL = tt.bondURL
+				t.Cleanup(func() { bondCfg.BondURL = orig })
+			}
+			t.Cleanup(closePools)
+
+			err := validateConfig(context.Background())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateConfig error = %v, expected none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateConfig error = %v, expected it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Periodically runs the Data-Driven Decaf aggregation and verifies it with Bond
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Starts the background verification job if VERIFY_INTERVAL_S is set (0 or unset disables it).
+// The job stops when ctx is cancelled.
+func startVerifyJob(ctx context.Context) {
+	interval, err := envSeconds("VERIFY_INTERVAL_S", 0)
+	if err != nil {
+		log.Fatalf("Could not start verification job: %v\n", err)
+	}
+	if interval == 0 {
+		return
+	}
+	slog.Info("Verification Job: Starting", "interval_s", interval.Seconds())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				slog.Info("Verification Job: Stopped")
+				return
+			case <-ticker.C:
+				runVerifyJob(ctx)
+			}
+		}
+	}()
+}
+
+// Builds the Bond payload from the database and verifies it, logging and counting the outcome
+func runVerifyJob(ctx context.Context) {
+	engine := selectedDBType
+	result, err := buildPayload(ctx, engine)
+	if err != nil {
+		slog.Error("Verification Job: Could not query", "db_type", engine, "error", err)
+		verifyJobRuns.WithLabelValues(engine, "query_error").Inc()
+		return
+	}
+	if emptyResult(ctx, result) {
+		slog.Warn("Verification Job: Empty dataset: no coffee rows returned", "db_type", engine)
+		emptyResults.WithLabelValues(engine).Inc()
+		verifyJobRuns.WithLabelValues(engine, "empty").Inc()
+		return
+	}
+	if skipBond() {
+		slog.Info("Verification Job: Verification skipped, SKIP_BOND is set", "db_type", engine)
+		verifyJobRuns.WithLabelValues(engine, "skipped").Inc()
+		return
+	}
+	res, err := callBond(ctx, bondCfg.VerifyMethod, bondCfg.VerifyPath, result)
+	if err != nil {
+		slog.Error("Verification Job: Verification failed", "db_type", engine, "error", err)
+		verifyJobRuns.WithLabelValues(engine, "bond_error").Inc()
+		return
+	}
+	if err := checkVerifyReply(res); err != nil {
+		slog.Error("Verification Job: Not verified", "db_type", engine, "error", err)
+		outcome := "bond_error"
+		if errors.Is(err, ErrBondRejected) {
+			outcome = "rejected"
+		}
+		verifyJobRuns.WithLabelValues(engine, outcome).Inc()
+		return
+	}
+	verifyJobRuns.WithLabelValues(engine, "verified").Inc()
+	slog.Info("Verification Job: Verified", "db_type", engine, "total", result.Total, "rows", result.RowCount, "response", string(res))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_RunVerifyJob(t *testing.T) {
+	useDBType(t, "CLOUD_SQL_MYSQL")
+
+	tests := []struct {
+		name        string
+		rows        int
+		bondStatus  int
+		bondReply   string
+		validate    bool
+		skipBond    bool
+		wantOutcome string
+		wantCalls   int32
+	}{
+		{name: "verified", rows: 3, bondStatus: http.StatusOK, wantOutcome: "verified", wantCalls: 1},
+		{name: "bond rejects", rows: 3, bondStatus: http.StatusBadRequest, wantOutcome: "bond_error", wantCalls: 1},
+		{name: "validated", rows: 3, bondStatus: http.StatusOK, bondReply: `{"valid":true}`, validate: true, wantOutcome: "verified", wantCalls: 1},
+		{name: "bond replies invalid", rows: 3, bondStatus: http.StatusOK, bondReply: `{"valid":false}`, validate: true, wantOutcome: "rejected", wantCalls: 1},
+		{name: "bond reply malformed", rows: 3, bondStatus: http.StatusOK, bondReply: `OK`, validate: true, wantOutcome: "bond_error", wantCalls: 1},
+		{name: "empty", rows: 0, wantOutcome: "empty"},
+		{name: "bond skipped", rows: 3, skipBond: true, wantOutcome: "skipped"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubDDDConnect(t, func(ctx context.Context, dbType string) (DDDBondPayload, error) {
+				return DDDBondPayload{MagicCoffee: "Robusta", Total: 7, RowCount: tt.rows}, nil
+			})
+			var calls int32
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.WriteHeader(tt.bondStatus)
+				w.Write([]byte(tt.bondReply))
+			})
+			bondCfg.MaxRetries = 0
+			bondCfg.ValidateResponse = tt.validate
+			if tt.skipBond {
+				t.Setenv("SKIP_BOND", "true")
+			}
+			before := testutil.ToFloat64(verifyJobRuns.WithLabelValues("CLOUD_SQL_MYSQL", tt.wantOutcome))
+
+			runVerifyJob(context.Background())
+
+			if got := testutil.ToFloat64(verifyJobRuns.WithLabelValues("CLOUD_SQL_MYSQL", tt.wantOutcome)) - before; got != 1 {
+				t.Errorf("%v runs counted %v times, expected 1", tt.wantOutcome, got)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("Bond called %v times, expected %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+// Version 2 of the verification API: an explicit request and a structured response envelope
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+const maxV2VerifyBodyBytes = 4 << 10
+
+// Most engines one POST /v2/verify/batch may ask for
+const maxV2BatchEngines = 10
+
+// Outcomes of verifying an aggregation with Bond
+const (
+	verdictVerified = "verified"
+	verdictFailed   = "failed"
+	verdictSkipped  = "skipped"
+)
+
+type v2VerifyRequest struct {
+	Engine  string          `json:"engine"`
+	Options v2VerifyOptions `json:"options"`
+}
+
+type v2VerifyOptions struct {
+	// Run the aggregation without sending it to Bond
+	DryRun bool `json:"dry_run"`
+}
+
+type v2VerifyResponse struct {
+	Data         DDDBondPayload `json:"data"`
+	Meta         v2Meta         `json:"meta"`
+	Verification v2Verification `json:"verification"`
+}
+
+type v2Meta struct {
+	Engine      string   `json:"engine"`
+	Project     string   `json:"project"`
+	RowCount    int      `json:"row_count"`
+	GeneratedAt jsonTime `json:"generated_at"`
+	DurationMs  int64    `json:"duration_ms"`
+	RequestID   string   `json:"request_id,omitempty"`
+}
+
+type v2Verification struct {
+	Verdict string `json:"verdict"`
+	// Bond's reply, as JSON when Bond replied with JSON
+	Bond  json.RawMessage `json:"bond,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+type v2BatchRequest struct {
+	Engines []string        `json:"engines"`
+	Options v2VerifyOptions `json:"options"`
+}
+
+type v2BatchResponse struct {
+	Results []v2BatchResult `json:"results"`
+}
+
+// One engine's part of a batch: its /v2/verify response, with the status /v2/verify would have
+// answered. Only the engine, status and error are set when the engine couldn't be aggregated.
+type v2BatchResult struct {
+	Engine string `json:"engine"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	*v2VerifyResponse
+}
+
+type v2Error struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Aggregates the requested engine and verifies the result with Bond
+func v2VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	l := loggerFrom(r.Context())
+
+	var req v2VerifyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxV2VerifyBodyBytes)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, v2Error{Error: "invalid request body"})
+		return
+	}
+	if err := checkV2Engine(req.Engine); err != nil {
+		writeJSON(w, http.StatusBadRequest, v2Error{Error: err.Error()})
+		return
+	}
+
+	result, status, err := v2Payload(r.Context(), req.Engine)
+	if err != nil {
+		writeJSON(w, status, v2Error{Error: err.Error()})
+		return
+	}
+	res := newV2VerifyResponse(r, req.Engine, result)
+	if req.Options.DryRun || result.Empty || skipBond() {
+		res.Verification.Verdict = verdictSkipped
+	} else {
+		body, err := callBond(r.Context(), bondCfg.VerifyMethod, bondCfg.VerifyPath, result)
+		if err == nil {
+			err = checkVerifyReply(body)
+		}
+		if err != nil {
+			l.Error("V2 Verify: Verification failed", "db_type", req.Engine, "error", err)
+			status = errorStatus(err)
+		}
+		res.Verification = v2Verdict(body, err)
+	}
+	res.Meta.GeneratedAt = jsonTime(time.Now())
+	res.Meta.DurationMs = time.Since(start).Milliseconds()
+	writeJSON(w, status, res)
+}
+
+// Aggregates the requested engines and verifies the results with Bond in a single request. Each
+// engine succeeds or fails on its own, so the response is a 200 with a status per engine unless
+// the request itself is invalid.
+func v2VerifyBatchHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	l := loggerFrom(r.Context())
+
+	var req v2BatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxV2VerifyBodyBytes)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, v2Error{Error: "invalid request body"})
+		return
+	}
+	if len(req.Engines) == 0 || len(req.Engines) > maxV2BatchEngines {
+		writeJSON(w, http.StatusBadRequest, v2Error{Error: fmt.Sprintf("expecting 1 to %v engines, got %v", maxV2BatchEngines, len(req.Engines))})
+		return
+	}
+	// Each engine is a full table scan, so it is only asked for once
+	seen := map[string]bool{}
+	for _, engine := range req.Engines {
+		if err := checkV2Engine(engine); err != nil {
+			writeJSON(w, http.StatusBadRequest, v2Error{Error: err.Error()})
+			return
+		}
+		if seen[engine] {
+			writeJSON(w, http.StatusBadRequest, v2Error{Error: fmt.Sprintf("engine %q is listed more than once", engine)})
+			return
+		}
+		seen[engine] = true
+	}
+
+	results := make([]v2BatchResult, len(req.Engines))
+	// The payloads sent to Bond, and the index in results of each
+	var (
+		payloads []any
+		sent     []int
+	)
+	for i, engine := range req.Engines {
+		results[i] = v2BatchResult{Engine: engine}
+		result, status, err := v2Payload(r.Context(), engine)
+		results[i].Status = status
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		res := newV2VerifyResponse(r, engine, result)
+		results[i].v2VerifyResponse = &res
+		if req.Options.DryRun || result.Empty || skipBond() {
+			res.Verification.Verdict = verdictSkipped
+			continue
+		}
+		payloads = append(payloads, result)
+		sent = append(sent, i)
+	}
+
+	if len(payloads) > 0 {
+		verdicts, err := sendJsonBatch(r.Context(), bondCfg.VerifyBatchPath, payloads)
+		if err != nil {
+			l.Error("V2 Verify: Batch verification failed", "engines", len(payloads), "error", err)
+		}
+		for j, i := range sent {
+			// A batch that failed as a whole fails every engine in it
+			var body []byte
+			itemErr := err
+			if err == nil {
+				body, itemErr = verdicts[j].Body, verdicts[j].Err
+				if itemErr == nil {
+					itemErr = checkVerifyReply(body)
+				}
+			}
+			if itemErr != nil {
+				if err == nil {
+					l.Error("V2 Verify: Verification failed", "db_type", results[i].Engine, "error", itemErr)
+				}
+				results[i].Status = errorStatus(itemErr)
+			}
+			results[i].Verification = v2Verdict(body, itemErr)
+		}
+	}
+
+	generated := jsonTime(time.Now())
+	for _, res := range results {
+		if res.v2VerifyResponse != nil {
+			res.Meta.GeneratedAt = generated
+			res.Meta.DurationMs = time.Since(start).Milliseconds()
+		}
+	}
+	writeJSON(w, http.StatusOK, v2BatchResponse{Results: results})
+}
+
+// Checks engine is one /v2/verify can aggregate, which is FAKE only when it is DB_TYPE
+func checkV2Engine(engine string) error {
+	if _, err := backendFor(engine); err != nil {
+		return fmt.Errorf("unknown engine %q (expecting one of %v)", engine, backendEngines(selectedDBType == "FAKE"))
+	}
+	return nil
+}
+
+// Aggregates engine, marking the result empty when there are no rows. When that fails it returns
+// the status to answer with, which for an empty table depends on EMPTY_RESULT_MODE.
+func v2Payload(ctx context.Context, engine string) (DDDBondPayload, int, error) {
+	l := loggerFrom(ctx)
+	result, err := buildPayload(ctx, engine)
+	if err != nil {
+		l.Error("V2 Verify: Could not query", "db_type", engine, "error", err)
+		return result, errorStatus(err), err
+	}
+	if emptyResult(ctx, result) {
+		l.Warn("V2 Verify: Empty dataset: no coffee rows returned", "db_type", engine)
+		emptyResults.WithLabelValues(engine).Inc()
+		status, err := emptyResultStatus()
+		if err != nil {
+			return result, http.StatusInternalServerError, err
+		}
+		if status != http.StatusOK {
+			return result, status, errEmptyDataset
+		}
+		result.Empty = true
+	}
+	return result, http.StatusOK, nil
+}
+
+var errEmptyDataset = errors.New("empty dataset")
+
+// The response for engine's result, still to be verified and timed
+func newV2VerifyResponse(r *http.Request, engine string, result DDDBondPayload) v2VerifyResponse {
+	return v2VerifyResponse{
+		Data: result,
+		Meta: v2Meta{
+			Engine:    engine,
+			Project:   result.Project,
+			RowCount:  result.RowCount,
+			RequestID: middleware.GetReqID(r.Context()),
+		},
+	}
+}
+
+// The verification for Bond's reply to a result and the error verifying it
+func v2Verdict(body []byte, err error) v2Verification {
+	var v v2Verification
+	if json.Valid(body) {
+		v.Bond = body
+	} else if len(body) > 0 {
+		v.Bond, _ = json.Marshal(string(body))
+	}
+	if err != nil {
+		v.Verdict = verdictFailed
+		v.Error = err.Error()
+	} else {
+		v.Verdict = verdictVerified
+	}
+	return v
+}
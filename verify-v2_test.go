@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+func Test_V2VerifyHandler(t *testing.T) {
+	origCfg := cfg
+	cfg.ProjectID = "test-project"
+	t.Cleanup(func() { cfg = origCfg })
+	useDBType(t, "CLOUD_SQL_MYSQL")
+	stubDDDConnect(t, func(ctx context.Context, dbType string) (DDDBondPayload, error) {
+		return DDDBondPayload{MagicCoffee: "Robusta", Total: 7, RowCount: 3}, nil
+	})
+
+	tests := []struct {
+		name        string
+		body        string
+		bondStatus  int
+		wantStatus  int
+		wantVerdict string
+		wantBond    string
+		wantCalls   int32
+		skipBond    bool
+		// Bond's reply, {"ok":true} when empty, checked with BOND_VALIDATE_RESPONSE when validate is set
+		bondReply string
+		validate  bool
+	}{
+		{
+			name:        "verified",
+			body:        `{"engine":"CLOUD_SQL_MYSQL"}`,
+			bondStatus:  http.StatusOK,
+			wantStatus:  http.StatusOK,
+			wantVerdict: verdictVerified,
+			wantBond:    `{"ok":true}`,
+			wantCalls:   1,
+		},
+		{
+			name:        "dry run",
+			body:        `{"engine":"CLOUD_SQL_MYSQL","options":{"dry_run":true}}`,
+			wantStatus:  http.StatusOK,
+			wantVerdict: verdictSkipped,
+		},
+		{
+			name:        "bond skipped",
+			body:        `{"engine":"CLOUD_SQL_MYSQL"}`,
+			skipBond:    true,
+			wantStatus:  http.StatusOK,
+			wantVerdict: verdictSkipped,
+		},
+		{
+			name:        "bond rejects",
+			body:        `{"engine":"ALLOY_DB"}`,
+			bondStatus:  http.StatusBadRequest,
+			wantStatus:  http.StatusBadGateway,
+			wantVerdict: verdictFailed,
+			wantCalls:   1,
+		},
+		{
+			name:        "validated",
+			body:        `{"engine":"CLOUD_SQL_MYSQL"}`,
+			bondStatus:  http.StatusOK,
+			bondReply:   `{"valid":true}`,
+			validate:    true,
+			wantStatus:  http.StatusOK,
+			wantVerdict: verdictVerified,
+			wantBond:    `{"valid":true}`,
+			wantCalls:   1,
+		},
+		{
+			name:        "bond replies invalid",
+			body:        `{"engine":"CLOUD_SQL_MYSQL"}`,
+			bondStatus:  http.StatusOK,
+			bondReply:   `{"valid":false,"message":"total is off by 2"}`,
+			validate:    true,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantVerdict: verdictFailed,
+			wantCalls:   1,
+		},
+		{
+			name:        "bond reply malformed",
+			body:        `{"engine":"CLOUD_SQL_MYSQL"}`,
+			bondStatus:  http.StatusOK,
+			validate:    true,
+			wantStatus:  http.StatusBadGateway,
+			wantVerdict: verdictFailed,
+			wantCalls:   1,
+		},
+		{
+			name:       "unknown engine",
+			body:       `{"engine":"ORACLE"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			// Made-up rows must not be verified under the real project
+			name:       "fake engine on a real database",
+			body:       `{"engine":"FAKE"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing engine",
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid body",
+			body:       `not json`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.WriteHeader(tt.bondStatus)
+				if tt.bondReply == "" {
+					w.Write([]byte(`{"ok":true}`))
+				}
+				w.Write([]byte(tt.bondReply))
+			})
+			bondCfg.ValidateResponse = tt.validate
+			if tt.skipBond {
+				t.Setenv("SKIP_BOND", "true")
+			}
+
+			rec := httptest.NewRecorder()
+			v2VerifyHandler(rec, httptest.NewRequest(http.MethodPost, "/v2/verify", strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %v, expected %v (body %s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("Bond called %v times, expected %v", got, tt.wantCalls)
+			}
+			if tt.wantVerdict == "" {
+				var e v2Error
+				if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil || e.Error == "" {
+					t.Errorf("body = %s, expected an error envelope", rec.Body)
+				}
+				return
+			}
+
+			// generated_at depends on TIME_FORMAT, so leave it out
+			var res struct {
+				Data DDDBondPayload
+				Meta struct {
+					RowCount int `json:"row_count"`
+					Project  string
+				}
+				Verification v2Verification
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatalf("could not decode response %s: %v", rec.Body, err)
+			}
+			if res.Verification.Verdict != tt.wantVerdict {
+				t.Errorf("verdict = %v, expected %v", res.Verification.Verdict, tt.wantVerdict)
+			}
+			if string(res.Verification.Bond) != tt.wantBond && tt.wantVerdict == verdictVerified {
+				t.Errorf("bond = %s, expected %s", res.Verification.Bond, tt.wantBond)
+			}
+			if tt.wantVerdict == verdictFailed && res.Verification.Error == "" {
+				t.Errorf("expected a verification error for a failed verdict")
+			}
+			if res.Data.Total != 7 || res.Data.MagicCoffee != "Robusta" || res.Data.Project != "test-project" {
+				t.Errorf("data = %+v, expected the enriched aggregation", res.Data)
+			}
+			if res.Meta.RowCount != 3 || res.Meta.Project != "test-project" {
+				t.Errorf("meta = %+v, expected the row count and project", res.Meta)
+			}
+		})
+	}
+}
+
+func Test_V2VerifyBatchHandler(t *testing.T) {
+	origCfg := cfg
+	cfg.ProjectID = "test-project"
+	t.Cleanup(func() { cfg = origCfg })
+	stubDDDConnect(t, func(ctx context.Context, dbType string) (DDDBondPayload, error) {
+		if dbType == "ALLOY_DB" {
+			return DDDBondPayload{}, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+		}
+		return DDDBondPayload{MagicCoffee: "Robusta", Total: 7, RowCount: 3}, nil
+	})
+
+	// Engine, status and verdict of a result, no verdict meaning it only has an error
+	type result struct {
+		engine  string
+		status  int
+		verdict string
+	}
+	tests := []struct {
+		name      string
+		body      string
+		bondReply string
+		// 5xx from Bond fails the whole batch
+		bondStatus   int
+		wantStatus   int
+		wantResults  []result
+		wantBondSent int
+		skipBond     bool
+		validate     bool
+	}{
+		{
+			name:       "partial failure",
+			body:       `{"engines":["CLOUD_SQL_MYSQL","ALLOY_DB","CLOUD_SQL_POSTGRES"]}`,
+			bondReply:  `[{"ok":true},{"status":400,"error":"wrong total"}]`,
+			wantStatus: http.StatusOK,
+			wantResults: []result{
+				{"CLOUD_SQL_MYSQL", http.StatusOK, verdictVerified},
+				{"ALLOY_DB", http.StatusServiceUnavailable, ""},
+				{"CLOUD_SQL_POSTGRES", http.StatusBadGateway, verdictFailed},
+			},
+			wantBondSent: 2,
+		},
+		{
+			name:       "validated",
+			body:       `{"engines":["CLOUD_SQL_MYSQL","CLOUD_SQL_POSTGRES","CLOUD_SQL_SQLSERVER"]}`,
+			bondReply:  `[{"valid":true},{"valid":false,"message":"total is off by 2"},{"ok":true}]`,
+			validate:   true,
+			wantStatus: http.StatusOK,
+			wantResults: []result{
+				{"CLOUD_SQL_MYSQL", http.StatusOK, verdictVerified},
+				{"CLOUD_SQL_POSTGRES", http.StatusUnprocessableEntity, verdictFailed},
+				{"CLOUD_SQL_SQLSERVER", http.StatusBadGateway, verdictFailed},
+			},
+			wantBondSent: 3,
+		},
+		{
+			name:       "bond fails the batch",
+			body:       `{"engines":["CLOUD_SQL_MYSQL","CLOUD_SQL_POSTGRES"]}`,
+			bondStatus: http.StatusInternalServerError,
+			wantStatus: http.StatusOK,
+			wantResults: []result{
+				{"CLOUD_SQL_MYSQL", http.StatusBadGateway, verdictFailed},
+				{"CLOUD_SQL_POSTGRES", http.StatusBadGateway, verdictFailed},
+			},
+			wantBondSent: 2,
+		},
+		{
+			name:       "dry run",
+			body:       `{"engines":["CLOUD_SQL_MYSQL"],"options":{"dry_run":true}}`,
+			wantStatus: http.StatusOK,
+			wantResults: []result{
+				{"CLOUD_SQL_MYSQL", http.StatusOK, verdictSkipped},
+			},
+		},
+		{
+			name:       "bond skipped",
+			body:       `{"engines":["CLOUD_SQL_MYSQL","CLOUD_SQL_POSTGRES"]}`,
+			skipBond:   true,
+			wantStatus: http.StatusOK,
+			wantResults: []result{
+				{"CLOUD_SQL_MYSQL", http.StatusOK, verdictSkipped},
+				{"CLOUD_SQL_POSTGRES", http.StatusOK, verdictSkipped},
+			},
+		},
+		{name: "unknown engine", body: `{"engines":["CLOUD_SQL_MYSQL","ORACLE"]}`, wantStatus: http.StatusBadRequest},
+		{name: "no engines", body: `{"engines":[]}`, wantStatus: http.StatusBadRequest},
+		{name: "duplicate engine", body: `{"engines":["CLOUD_SQL_MYSQL","CLOUD_SQL_POSTGRES","CLOUD_SQL_MYSQL"]}`, wantStatus: http.StatusBadRequest},
+		{name: "too many engines", body: `{"engines":["FAKE","FAKE","FAKE","FAKE","FAKE","FAKE","FAKE","FAKE","FAKE","FAKE","FAKE"]}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls, sent int
+			stubBond(t, func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if r.URL.Path != defaultDDDVerifyBatchPath {
+					t.Errorf("Bond called at %v, expected %v", r.URL.Path, defaultDDDVerifyBatchPath)
+				}
+				var payloads []DDDBondPayload
+				json.NewDecoder(r.Body).Decode(&payloads)
+				sent = len(payloads)
+				if tt.bondStatus != 0 {
+					w.WriteHeader(tt.bondStatus)
+				}
+				w.Write([]byte(tt.bondReply))
+			})
+			bondCfg.MaxRetries = 0
+			bondCfg.ValidateResponse = tt.validate
+			if tt.skipBond {
+				t.Setenv("SKIP_BOND", "true")
+			}
+
+			rec := httptest.NewRecorder()
+			v2VerifyBatchHandler(rec, httptest.NewRequest(http.MethodPost, "/v2/verify/batch", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %v, expected %v (body %s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if sent != tt.wantBondSent || calls > 1 {
+				t.Errorf("Bond got %v payloads in %v calls, expected %v in at most one", sent, calls, tt.wantBondSent)
+			}
+			if tt.wantResults == nil {
+				return
+			}
+
+			// generated_at depends on TIME_FORMAT, so leave it out
+			var res struct {
+				Results []struct {
+					Engine       string
+					Status       int
+					Error        string
+					Data         *DDDBondPayload
+					Meta         struct{ Engine string }
+					Verification *v2Verification
+				}
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatalf("could not decode response %s: %v", rec.Body, err)
+			}
+			if len(res.Results) != len(tt.wantResults) {
+				t.Fatalf("results = %+v, expected %v", res.Results, len(tt.wantResults))
+			}
+			for i, want := range tt.wantResults {
+				got := res.Results[i]
+				if got.Engine != want.engine || got.Status != want.status {
+					t.Errorf("result %v = %v %v, expected %v %v", i, got.Engine, got.Status, want.engine, want.status)
+				}
+				if want.verdict == "" {
+					if got.Data != nil || got.Verification != nil || got.Error == "" {
+						t.Errorf("result %v = %+v, expected only an error", i, got)
+					}
+					continue
+				}
+				if got.Verification == nil || got.Verification.Verdict != want.verdict {
+					t.Errorf("result %v verification = %+v, expected verdict %v", i, got.Verification, want.verdict)
+				}
+				if got.Data == nil || got.Data.Total != 7 || got.Data.DB != want.engine || got.Meta.Engine != want.engine {
+					t.Errorf("result %v = %+v, expected %v's aggregation", i, got, want.engine)
+				}
+			}
+		})
+	}
+}